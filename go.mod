@@ -0,0 +1,13 @@
+module github.com/alfatraining/logrus-hooks
+
+go 1.20
+
+require (
+	github.com/sirupsen/logrus v1.9.3
+	go.opentelemetry.io/otel/trace v1.24.0
+)
+
+require (
+	go.opentelemetry.io/otel v1.24.0 // indirect
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+)
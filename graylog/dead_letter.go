@@ -0,0 +1,63 @@
+package graylog
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/alfatraining/go-gelf/gelf"
+)
+
+// DefaultDeadLetterMaxSize is the size in bytes above which the dead letter
+// file is rotated, see Hook.DeadLetterFile.
+const DefaultDeadLetterMaxSize = 10 * 1024 * 1024
+
+// writeDeadLetter appends m to the dead letter file, rotating it when it
+// grows too large. It must only be called with sendMu held.
+func (hook *Hook) writeDeadLetter(m *gelf.Message) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if hook.deadLetters == nil {
+		if err := hook.openDeadLetterFile(); err != nil {
+			return err
+		}
+	}
+
+	maxSize := hook.DeadLetterMaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultDeadLetterMaxSize
+	}
+	if hook.deadLettersSize > 0 && hook.deadLettersSize+int64(len(line)) > maxSize {
+		hook.deadLetters.Close()
+		hook.deadLetters = nil
+		if err := os.Rename(hook.DeadLetterFile, hook.DeadLetterFile+".1"); err != nil {
+			return err
+		}
+		if err := hook.openDeadLetterFile(); err != nil {
+			return err
+		}
+	}
+
+	n, err := hook.deadLetters.Write(line)
+	hook.deadLettersSize += int64(n)
+	return err
+}
+
+// openDeadLetterFile opens the dead letter file for appending
+func (hook *Hook) openDeadLetterFile() error {
+	f, err := os.OpenFile(hook.DeadLetterFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	hook.deadLetters = f
+	hook.deadLettersSize = info.Size()
+	return nil
+}
@@ -0,0 +1,89 @@
+package graylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alfatraining/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDeadLetterFile(t *testing.T) {
+	hook, _ := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.DeadLetterFile = filepath.Join(t.TempDir(), "dead_letters.log")
+	hook.gelfLogger.Close() // make every write fail
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.WithField("withField", "1").Error("test message")
+
+	var data []byte
+	for deadline := time.Now().Add(time.Second); len(data) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(hook.DeadLetterFile)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		t.Fatalf("expected a dead letter, got none")
+	}
+	var msg gelf.Message
+	if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if msg.Short != "test message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "test message", msg.Short)
+	}
+	if msg.Extra["_withField"] != "1" {
+		t.Errorf("Expected extra '_withField' to be %#v, got %#v", "1", msg.Extra["_withField"])
+	}
+}
+
+func TestDeadLetterFileRotation(t *testing.T) {
+	hook := &Hook{
+		DeadLetterFile:    filepath.Join(t.TempDir(), "dead_letters.log"),
+		DeadLetterMaxSize: 200,
+	}
+	m := &gelf.Message{Version: "1.1", Host: "test", Short: "test message"}
+	for i := 0; i < 5; i++ {
+		if err := hook.writeDeadLetter(m); err != nil {
+			t.Fatalf("writeDeadLetter: %s", err)
+		}
+	}
+
+	for _, path := range []string{hook.DeadLetterFile, hook.DeadLetterFile + ".1"} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %s", err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("expected %s to be at most 200 bytes, got %d", path, info.Size())
+		}
+	}
+}
+
+func TestDeadLetterFileError(t *testing.T) {
+	var errs []error
+	hook, _ := newTestHook(t, WithExtra(map[string]interface{}{}), WithSynchronous(1))
+	hook.DeadLetterFile = filepath.Join(t.TempDir(), "missing", "dead_letters.log")
+	hook.OnError = func(err error) { errs = append(errs, err) }
+	hook.gelfLogger.Close() // make every write fail
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Error("test message")
+
+	if n := hook.WriteErrors(); n != 2 {
+		t.Errorf("WriteErrors: expected the write and the dead letter errors, got %d", n)
+	}
+	if len(errs) != 2 || !errors.Is(errs[1], fs.ErrNotExist) {
+		t.Errorf("OnError: expected the error of the dead letter file last, got %v", errs)
+	}
+}
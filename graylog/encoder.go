@@ -0,0 +1,132 @@
+package graylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/alfatraining/go-gelf/gelf"
+)
+
+// Encoder returns the bytes written to a stream transport (TCP, TLS or Unix
+// socket) for a message, delimiter included, see WithEncoder.
+type Encoder func(m *gelf.Message) ([]byte, error)
+
+// EncodeJSON encodes a message as a JSON document terminated by a null byte,
+// the GELF framing over TCP. It is the default Encoder.
+func EncodeJSON(m *gelf.Message) ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, 0), nil
+}
+
+// EncodeMsgpack encodes a message as a MessagePack map with the keys and
+// values of its JSON document, for the collectors accepting msgpack GELF,
+// which is smaller and faster to parse. MessagePack values delimit
+// themselves: no null byte is added, as it may be part of the values. As it
+// goes through JSON, it takes longer to encode than EncodeJSON: it saves
+// bandwidth and work on the collector, not in the hook, see BenchmarkEncode.
+func EncodeMsgpack(m *gelf.Message) ([]byte, error) {
+	// go through JSON to keep the keys and the layout of go-gelf
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(make([]byte, 0, len(b)), doc)
+}
+
+// appendMsgpack appends the MessagePack encoding of v, a value decoded from
+// JSON with json.Decoder.UseNumber, to b
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f)), nil
+	case string:
+		b = appendMsgpackHeader(b, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(b, v...), nil
+	case []interface{}:
+		b = appendMsgpackHeader(b, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			var err error
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackHeader(b, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			var err error
+			if b, err = appendMsgpack(b, k); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("graylog: can't encode %T values as msgpack", v)
+}
+
+// appendMsgpackHeader appends the header of a string, array or map of n
+// elements: fix|n when n < fixMax, then the code of the 8 (if any), 16 or
+// 32 bits length
+func appendMsgpackHeader(b []byte, n int, fix byte, fixMax int, code8, code16, code32 byte) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		return append(b, code8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, code16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, code32), uint32(n))
+}
+
+// appendMsgpackInt appends the shortest MessagePack encoding of i
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+}
@@ -0,0 +1,140 @@
+package graylog
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alfatraining/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAppendMsgpack(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{false, "c2"},
+		{json.Number("1"), "01"},
+		{json.Number("-1"), "ff"},
+		{json.Number("-33"), "d0df"},
+		{json.Number("200"), "d100c8"},
+		{json.Number("70000"), "d200011170"},
+		{json.Number("5000000000"), "d3000000012a05f200"},
+		{json.Number("1.5"), "cb3ff8000000000000"},
+		{"a", "a161"},
+		{strings.Repeat("a", 40), "d928" + strings.Repeat("61", 40)},
+		{[]interface{}{"a", json.Number("1")}, "92a16101"},
+		{map[string]interface{}{"b": json.Number("1"), "a": true}, "82a161c3a16201"},
+	} {
+		b, err := appendMsgpack(nil, test.value)
+		if err != nil {
+			t.Fatalf("appendMsgpack(%#v): %s", test.value, err)
+		}
+		if got := hex.EncodeToString(b); got != test.expected {
+			t.Errorf("appendMsgpack(%#v): expected %s, got %s", test.value, test.expected, got)
+		}
+	}
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	m := &gelf.Message{Version: "1.1", Host: "host", Short: "short", Extra: map[string]interface{}{"_n": 1}}
+	b, err := EncodeMsgpack(m)
+	if err != nil {
+		t.Fatalf("EncodeMsgpack: %s", err)
+	}
+	var doc map[string]interface{}
+	j, _ := json.Marshal(m)
+	json.Unmarshal(j, &doc)
+	if b[0] != 0x80|byte(len(doc)) {
+		t.Errorf("expected a map of the %d keys of the JSON document, got %x", len(doc), b[0])
+	}
+	for _, kv := range []string{"\xadshort_message\xa5short", "\xa2_n\x01"} {
+		if !bytes.Contains(b, []byte(kv)) {
+			t.Errorf("expected %q in %q", kv, b)
+		}
+	}
+}
+
+func TestWithEncoder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+
+	hook, err := NewGraylogHookWithOptions(l.Addr().String(), WithTCP(), WithEncoder(EncodeMsgpack), WithSynchronous(1))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+	hook.Close()
+
+	b := <-received
+	if len(b) == 0 || b[0]&0xf0 != 0x80 && b[0] != 0xde {
+		t.Fatalf("expected a msgpack map, got %q", b)
+	}
+	if !bytes.Contains(b, []byte("\xactest message")) {
+		t.Errorf("expected the message in %q", b)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	m := &gelf.Message{
+		Version:    "1.1",
+		Host:       "api-7d9f8b6c4-x2x9k",
+		Short:      "request handled",
+		TimeUnixMs: time.Now().UnixNano() / int64(time.Millisecond),
+		Level:      6,
+		Facility:   "api",
+		File:       "/go/src/app/handlers/orders.go",
+		Line:       142,
+		Extra: map[string]interface{}{
+			"_method":      "GET",
+			"_path":        "/v1/orders/1234",
+			"_status":      200,
+			"_duration_ms": 12.5,
+			"_cached":      false,
+			"_request_id":  "01HF3J5Z9Q8K7X6W5V4T3S2R1P",
+		},
+	}
+	for _, test := range []struct {
+		name   string
+		encode Encoder
+	}{
+		{"json", EncodeJSON},
+		{"msgpack", EncodeMsgpack},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				p, err := test.encode(m)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(p)
+			}
+			b.ReportMetric(float64(size), "bytes/msg")
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package graylog
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fieldNameRegexp matches the names allowed by GELF for additional fields,
+// without the leading underscore.
+var fieldNameRegexp = regexp.MustCompile(`^[\w\.\-]+$`)
+
+// reservedFieldNames can't be used as names of additional fields, as
+// "_id" is reserved by Graylog.
+var reservedFieldNames = map[string]bool{"id": true}
+
+// gelfAttributes are the names of the attributes of GELF messages
+var gelfAttributes = map[string]bool{
+	"version":       true,
+	"host":          true,
+	"short_message": true,
+	"full_message":  true,
+	"timestamp":     true,
+	"level":         true,
+	"facility":      true,
+	"line":          true,
+	"file":          true,
+}
+
+// ReservedFieldPolicy tells what to do with the fields named like the
+// attributes of GELF messages, or "id" which is reserved by Graylog, see
+// Hook.ReservedFieldPolicy.
+type ReservedFieldPolicy int
+
+const (
+	// RenameReservedFields sends the fields with the "entry_" prefix
+	RenameReservedFields ReservedFieldPolicy = iota
+	// DropReservedFields doesn't send the fields
+	DropReservedFields
+	// AllowReservedFields sends the fields as any other field
+	AllowReservedFields
+)
+
+// RedactedValue replaces the values of the fields listed in Hook.RedactKeys
+const RedactedValue = "[REDACTED]"
+
+// reservedFieldPrefix is prepended to the renamed fields, see
+// RenameReservedFields.
+const reservedFieldPrefix = "entry_"
+
+// KeyValueFields is a Hook.MessageFieldExtractor returning the key=value
+// pairs of a message, like "status=500 latency=23ms". The values are numbers
+// when they parse as such, strings otherwise. The words which are not pairs
+// with a valid field name are ignored.
+func KeyValueFields(message string) map[string]interface{} {
+	var fields map[string]interface{}
+	for _, word := range strings.Fields(message) {
+		i := strings.IndexByte(word, '=')
+		if i <= 0 || !fieldNameRegexp.MatchString(word[:i]) {
+			continue
+		}
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+		k, v := word[:i], word[i+1:]
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			fields[k] = n
+		} else if f, err := strconv.ParseFloat(v, 64); err == nil {
+			fields[k] = f
+		} else {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// DefaultFlattenDepth is the Hook.FlattenDepth set by
+// NewGraylogHookWithOptions
+const DefaultFlattenDepth = 3
+
+// addFields adds the fields of an entry, of its context or of Hook.Extra to
+// the additional fields of a message.
+func (hook *Hook) addFields(extra map[string]interface{}, fields map[string]interface{}) {
+	for k, v := range fields {
+		hook.addField(extra, k, v, hook.FlattenDepth)
+	}
+}
+
+// addField adds a field to the additional fields of a message, flattening
+// its value up to depth levels, see Hook.FlattenDepth.
+func (hook *Hook) addField(extra map[string]interface{}, k string, v interface{}, depth int) {
+	if hook.redacted(k) {
+		v = RedactedValue
+	}
+	if depth > 0 {
+		if nested, ok := flatten(v); ok {
+			sep := hook.FlattenSeparator
+			if sep == "" {
+				sep = "_"
+			}
+			for nk, nv := range nested {
+				if hook.redacted(nk) {
+					nv = RedactedValue
+				}
+				hook.addField(extra, k+sep+nk, nv, depth-1)
+			}
+			return
+		}
+	}
+	name, ok := hook.fieldName(k)
+	if !ok {
+		return
+	}
+	extra[name] = hook.formatValue(v)
+}
+
+// redacted tells whether the values of the fields named k must be replaced
+// with RedactedValue, see Hook.RedactKeys.
+func (hook *Hook) redacted(k string) bool {
+	hook.mu.RLock()
+	keys := hook.RedactKeys
+	hook.mu.RUnlock()
+	for _, key := range keys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten returns the keys and values of a map with string keys, or the
+// exported fields of a struct, named after their JSON tag if any. It returns
+// false for the other values, and for the values formatting themselves, like
+// time.Time.
+func flatten(v interface{}) (map[string]interface{}, bool) {
+	switch v.(type) {
+	case nil, fmt.Stringer, error, json.Marshaler, encoding.TextMarshaler:
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+			return nil, false
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		fields := make(map[string]interface{}, rv.Len())
+		for _, key := range rv.MapKeys() {
+			fields[key.String()] = rv.MapIndex(key).Interface()
+		}
+		return fields, true
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+			name := f.Name
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			fields[name] = rv.Field(i).Interface()
+		}
+		return fields, true
+	}
+	return nil, false
+}
+
+// fieldName returns the name of the additional field for a field of an
+// entry, or false if the field must not be sent. The characters not allowed
+// by GELF are replaced with underscores, and "id", reserved by Graylog, is
+// handled like the GELF attributes.
+func (hook *Hook) fieldName(k string) (string, bool) {
+	if k == "" {
+		return "", false
+	}
+	k = sanitizeFieldName(k)
+	if gelfAttributes[k] || reservedFieldNames[k] {
+		switch hook.ReservedFieldPolicy {
+		case DropReservedFields:
+			return "", false
+		case RenameReservedFields:
+			k = reservedFieldPrefix + k
+		}
+	}
+	// "[...] every field you send and prefix with a _ (underscore) will be treated as an additional field."
+	prefix := hook.FieldPrefix
+	if !strings.HasPrefix(prefix, "_") {
+		prefix = "_" + prefix
+	}
+	return prefix + k, true
+}
+
+// coerceFields applies rules, see Hook.FieldTypeRules, to the additional
+// fields of a message.
+func (hook *Hook) coerceFields(extra map[string]interface{}, rules map[string]string) {
+	for k, typ := range rules {
+		name, ok := hook.fieldName(k)
+		if !ok {
+			continue
+		}
+		v, ok := extra[name]
+		if !ok {
+			continue
+		}
+		if coerced, ok := coerceValue(v, typ); ok {
+			extra[name] = coerced
+		}
+	}
+}
+
+// coerceValue converts a formatted field value to typ, or returns false when
+// it can't.
+func coerceValue(v interface{}, typ string) (interface{}, bool) {
+	switch typ {
+	case "string":
+		if b, ok := v.(bool); ok {
+			return strconv.FormatBool(b), true
+		}
+		return fmt.Sprint(v), true
+	case "number":
+		if isNumber(v) {
+			return v, true
+		}
+		switch v := v.(type) {
+		case bool:
+			if v {
+				return 1, true
+			}
+			return 0, true
+		case string:
+			if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return n, true
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, true
+			}
+		}
+	case "bool":
+		if n, ok := v.(json.Number); ok {
+			f, err := n.Float64()
+			return f != 0, err == nil
+		}
+		if isNumber(v) {
+			return !reflect.ValueOf(v).IsZero(), true
+		}
+		switch v := v.(type) {
+		case bool:
+			return v, true
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// isNumber returns true for the values sent as JSON numbers
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr, float32, float64, json.Number:
+		return true
+	}
+	return false
+}
+
+// sanitizeFieldName replaces the characters not matched by fieldNameRegexp
+// with underscores.
+func sanitizeFieldName(k string) string {
+	valid := func(r rune) bool {
+		return r == '_' || r == '.' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+	}
+	if strings.IndexFunc(k, func(r rune) bool { return !valid(r) }) < 0 {
+		return k
+	}
+	return strings.Map(func(r rune) rune {
+		if valid(r) {
+			return r
+		}
+		return '_'
+	}, k)
+}
+
+// ValidateFields checks the names and the values of fields, as passed to
+// logrus.WithFields, against the constraints of GELF and Graylog, and returns
+// the problems found. Nothing is sent.
+func ValidateFields(fields map[string]interface{}) []error {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, k := range keys {
+		if err := validateFieldName(k); err != nil {
+			errs = append(errs, err)
+		}
+		if err := validateFieldValue(k, fields[k]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// validateFieldName checks the name of an additional field, without the
+// leading underscore.
+func validateFieldName(k string) error {
+	if !fieldNameRegexp.MatchString(k) {
+		return fmt.Errorf("field %q: name must only contain letters, digits, underscores, dots and dashes", k)
+	}
+	if reservedFieldNames[k] {
+		return fmt.Errorf("field %q: name is reserved", k)
+	}
+	if gelfAttributes[k] {
+		return fmt.Errorf("field %q: name is a GELF attribute, see ReservedFieldPolicy", k)
+	}
+	return nil
+}
+
+// validateFieldValue checks the value of an additional field, as formatted
+// by the hook. Booleans are accepted: they are sent as true and false, or as
+// 1 and 0 with BooleansAsNumbers.
+func validateFieldValue(k string, v interface{}) error {
+	if v == nil {
+		return fmt.Errorf("field %q: value is nil", k)
+	}
+	f := formatForJSON(v)
+	if _, ok := f.(string); ok || isNumber(f) {
+		return nil
+	}
+	if _, ok := f.(bool); ok {
+		return nil
+	}
+	return fmt.Errorf("field %q: %T values are neither strings, numbers nor booleans", k, v)
+}
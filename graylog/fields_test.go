@@ -0,0 +1,270 @@
+package graylog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateFields(t *testing.T) {
+	errs := ValidateFields(map[string]interface{}{
+		"valid.name-1": "ok",
+		"count":        42,
+		"with space":   "ko",
+		"id":           "ko",
+		"enabled":      true,
+		"host":         "ko",
+		"":             "ko",
+	})
+
+	expected := []string{
+		`field "": name must only contain letters, digits, underscores, dots and dashes`,
+		`field "host": name is a GELF attribute, see ReservedFieldPolicy`,
+		`field "id": name is reserved`,
+		`field "with space": name must only contain letters, digits, underscores, dots and dashes`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("error %d: expected %q, got %q", i, expected[i], err.Error())
+		}
+	}
+}
+
+func TestReservedFieldPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy   ReservedFieldPolicy
+		field    string
+		expected string // empty when dropped
+	}{
+		{RenameReservedFields, "host", "_entry_host"},
+		{RenameReservedFields, "version", "_entry_version"},
+		{RenameReservedFields, "timestamp", "_entry_timestamp"},
+		{RenameReservedFields, "hostname", "_hostname"},
+		{DropReservedFields, "host", ""},
+		{DropReservedFields, "version", ""},
+		{DropReservedFields, "timestamp", ""},
+		{DropReservedFields, "hostname", "_hostname"},
+		{AllowReservedFields, "host", "_host"},
+		{AllowReservedFields, "version", "_version"},
+		{AllowReservedFields, "timestamp", "_timestamp"},
+	} {
+		hook := &Hook{ReservedFieldPolicy: test.policy}
+		extra := map[string]interface{}{}
+		hook.addFields(extra, map[string]interface{}{test.field: "value"})
+
+		if test.expected == "" {
+			if len(extra) != 0 {
+				t.Errorf("policy %d: expected %#v to be dropped, got %v", test.policy, test.field, extra)
+			}
+			continue
+		}
+		if extra[test.expected] != "value" {
+			t.Errorf("policy %d: expected %#v to be sent as %#v, got %v", test.policy, test.field, test.expected, extra)
+		}
+	}
+}
+
+func TestKeyValueFields(t *testing.T) {
+	fields := KeyValueFields("request done status=500 latency=23ms ratio=0.5 =x a=b=c")
+	expected := map[string]interface{}{
+		"status":  int64(500),
+		"latency": "23ms",
+		"ratio":   0.5,
+		"a":       "b=c",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected %v, got %v", expected, fields)
+	}
+	if fields := KeyValueFields("no pairs here"); fields != nil {
+		t.Errorf("expected no fields, got %v", fields)
+	}
+}
+
+func TestMessageFieldExtractor(t *testing.T) {
+	hook, _ := newTestHook(t)
+	hook.MessageFieldExtractor = KeyValueFields
+
+	entry := logrus.WithField("status", 404)
+	entry.Message = "status=500 latency=23ms"
+	msg := hook.EntryToMessage(entry, Caller{})
+	if msg.Short != "status=500 latency=23ms" {
+		t.Errorf("Short: expected the message unchanged, got %#v", msg.Short)
+	}
+	if msg.Extra["_status"] != 404 {
+		t.Errorf("_status: expected the field of the entry, got %#v", msg.Extra["_status"])
+	}
+	if msg.Extra["_latency"] != "23ms" {
+		t.Errorf("_latency: expected %#v, got %#v", "23ms", msg.Extra["_latency"])
+	}
+}
+
+func TestFieldTypeRules(t *testing.T) {
+	for _, test := range []struct {
+		typ      string
+		value    interface{}
+		expected interface{}
+	}{
+		{"string", 42, "42"},
+		{"string", 1.5, "1.5"},
+		{"string", true, "true"},
+		{"string", "id", "id"},
+		{"number", "500", int64(500)},
+		{"number", " 0.25 ", 0.25},
+		{"number", true, 1},
+		{"number", false, 0},
+		{"number", 42, 42},
+		{"number", "abc", "abc"}, // unchanged
+		{"bool", "true", true},
+		{"bool", "0", false},
+		{"bool", 1, true},
+		{"bool", 0.0, false},
+		{"bool", "maybe", "maybe"}, // unchanged
+		{"unknown", 42, 42},        // unchanged
+	} {
+		hook := &Hook{FieldTypeRules: map[string]string{"field": test.typ}}
+		extra := map[string]interface{}{}
+		hook.addFields(extra, map[string]interface{}{"field": test.value, "other": "1"})
+		hook.coerceFields(extra, hook.FieldTypeRules)
+
+		if extra["_field"] != test.expected {
+			t.Errorf("%s %#v: expected %#v, got %#v", test.typ, test.value, test.expected, extra["_field"])
+		}
+		if extra["_other"] != "1" {
+			t.Errorf("%s %#v: expected the other field unchanged, got %#v", test.typ, test.value, extra["_other"])
+		}
+	}
+}
+
+func TestFlattenFields(t *testing.T) {
+	type address struct {
+		City    string `json:"city"`
+		Zip     string `json:"-"`
+		Country string
+		secret  string
+	}
+	hook, _ := newTestHook(t)
+	when := time.Unix(1500000000, 0)
+	entry := logrus.WithFields(logrus.Fields{
+		"user": map[string]interface{}{
+			"id":   7,
+			"role": map[string]interface{}{"name": "admin"},
+		},
+		"address": &address{City: "Berlin", Zip: "10115", Country: "DE", secret: "x"},
+		"when":    when,
+	})
+	msg := hook.EntryToMessage(entry, Caller{})
+
+	expected := map[string]interface{}{
+		"_user_id":         7,
+		"_user_role_name":  "admin",
+		"_address_city":    "Berlin",
+		"_address_Country": "DE",
+		"_when":            when.String(),
+	}
+	for k, v := range expected {
+		if msg.Extra[k] != v {
+			t.Errorf("%s: expected %#v, got %#v", k, v, msg.Extra[k])
+		}
+	}
+	for _, k := range []string{"_user", "_address", "_address_Zip", "_address_secret"} {
+		if v, ok := msg.Extra[k]; ok {
+			t.Errorf("%s: expected none, got %#v", k, v)
+		}
+	}
+
+	// Past the depth, the values are sent as JSON strings
+	hook.FlattenDepth = 1
+	hook.FlattenSeparator = "."
+	msg = hook.EntryToMessage(entry, Caller{})
+	if msg.Extra["_user.id"] != 7 {
+		t.Errorf("_user.id: expected 7, got %#v", msg.Extra["_user.id"])
+	}
+	if msg.Extra["_user.role"] != `{"name":"admin"}` {
+		t.Errorf("_user.role: expected %#v, got %#v", `{"name":"admin"}`, msg.Extra["_user.role"])
+	}
+}
+
+func TestRedactKeys(t *testing.T) {
+	hook, err := NewGraylogHookWithOptions("127.0.0.1:0", WithRedactKeys("password", "authorization"))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	msg := hook.EntryToMessage(logrus.WithFields(logrus.Fields{
+		"Password":      "hunter2",
+		"AUTHORIZATION": map[string]interface{}{"scheme": "Bearer"},
+		"user":          map[string]interface{}{"name": "alice", "password": "hunter2"},
+		"foo":           "bar",
+	}), Caller{})
+
+	expected := map[string]interface{}{
+		"_Password":      RedactedValue,
+		"_AUTHORIZATION": RedactedValue,
+		"_user_password": RedactedValue,
+		"_user_name":     "alice",
+		"_foo":           "bar",
+	}
+	for k, v := range expected {
+		if msg.Extra[k] != v {
+			t.Errorf("%s: expected %#v, got %#v", k, v, msg.Extra[k])
+		}
+	}
+	if v, ok := msg.Extra["_AUTHORIZATION_scheme"]; ok {
+		t.Errorf("_AUTHORIZATION_scheme: expected none, got %#v", v)
+	}
+}
+
+func TestSanitizeFieldNames(t *testing.T) {
+	hook := &Hook{}
+	extra := map[string]interface{}{}
+	hook.addFields(extra, map[string]interface{}{
+		"request id":  "a",
+		"id":          "b",
+		"path/to:key": "c",
+		"valid.name-": "d",
+		"":            "e",
+	})
+	expected := map[string]interface{}{
+		"_request_id":  "a",
+		"_entry_id":    "b",
+		"_path_to_key": "c",
+		"_valid.name-": "d",
+	}
+	if !reflect.DeepEqual(extra, expected) {
+		t.Errorf("expected %v, got %v", expected, extra)
+	}
+	for name := range extra {
+		if err := validateFieldName(name[1:]); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFieldPrefix(t *testing.T) {
+	hook, _ := newTestHook(t, WithExtra(map[string]interface{}{"version": "1.2"}))
+	hook.FieldPrefix = "_app_"
+	entry := logrus.WithField("user", "alice")
+	entry.Level = logrus.InfoLevel
+	msg := hook.EntryToMessage(entry, Caller{})
+
+	expected := map[string]interface{}{
+		"_app_user":          "alice",
+		"_app_entry_version": "1.2",
+		"_severity":          "info",
+	}
+	for k, v := range expected {
+		if msg.Extra[k] != v {
+			t.Errorf("%s: expected %#v, got %#v (%v)", k, v, msg.Extra[k], msg.Extra)
+		}
+	}
+
+	// The underscore required by GELF is kept
+	hook.FieldPrefix = "app."
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_app.user"] != "alice" {
+		t.Errorf("_app.user: expected %#v, got %v", "alice", msg.Extra)
+	}
+}
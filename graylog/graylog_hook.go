@@ -2,21 +2,102 @@ package graylog
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	mathrand "math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/alfatraining/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
 )
 
-// Set graylog.BufSize = <value> _before_ calling NewGraylogHook
+// Set graylog.BufSize = <value> _before_ calling NewGraylogHook, or use
+// WithBufSize to size the buffer of a single hook.
 // Once the buffer is full, logging will start blocking, waiting for slots to
-// be available in the queue.
+// be available in the queue, unless Hook.Blocking is false.
 var BufSize uint = 8192
 
+// DuplicateHookPolicy is what the constructors do when a hook with the same
+// address and facility was already created, see WithDeduplicateHooks.
+type DuplicateHookPolicy int
+
+const (
+	// AllowDuplicateHooks creates the hook anyway (default), for setups
+	// using several hooks on purpose.
+	AllowDuplicateHooks DuplicateHookPolicy = iota
+	// WarnDuplicateHooks creates the hook and logs a warning.
+	WarnDuplicateHooks
+	// RefuseDuplicateHooks returns ErrDuplicateHook instead of the hook.
+	RefuseDuplicateHooks
+)
+
+// DefaultVersion is the GELF version of the messages when Hook.Version is
+// empty
+const DefaultVersion = "1.1"
+
+// ErrBufferFull is passed to Hook.OnError for the entries dropped while the
+// buffer is full
+var ErrBufferFull = errors.New("graylog: buffer full, entry dropped")
+
+// ErrDuplicateHook is returned by the constructors for a duplicate hook, see
+// RefuseDuplicateHooks.
+var ErrDuplicateHook = errors.New("graylog: a hook with the same address and facility already exists")
+
+// ErrNoAddress is returned by NewGraylogHookWithFailover without addresses
+var ErrNoAddress = errors.New("graylog: no address")
+
+// hooks counts the hooks created by address and facility
+var hooks = struct {
+	sync.Mutex
+	created map[string]int
+}{created: map[string]int{}}
+
+// registerHook records a hook for addr and facility, and tells whether it
+// must be created according to policy.
+func registerHook(addr, facility string, policy DuplicateHookPolicy) bool {
+	hooks.Lock()
+	defer hooks.Unlock()
+	key := hookKey(addr, facility)
+	switch {
+	case hooks.created[key] == 0 || policy == AllowDuplicateHooks:
+	case policy == RefuseDuplicateHooks:
+		return false
+	default:
+		logrus.WithFields(logrus.Fields{"addr": addr, "facility": facility}).Warn("A graylog hook with the same address and facility already exists")
+	}
+	hooks.created[key]++
+	return true
+}
+
+// unregisterHook forgets a hook recorded by registerHook, once it is closed
+func unregisterHook(key string) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	if hooks.created[key]--; hooks.created[key] <= 0 {
+		delete(hooks.created, key)
+	}
+}
+
+// hookKey returns the key of the hooks for addr and facility in hooks
+func hookKey(addr, facility string) string {
+	return addr + "|" + facility
+}
+
 //
 // 0       Emergency: system is unusable
 // 1       Alert: action must be taken immediately
@@ -26,134 +107,2045 @@ var BufSize uint = 8192
 // 5       Notice: normal but significant condition
 // 6       Informational: informational messages
 // 7       Debug: debug-level messages
-var levelMap = map[logrus.Level]int32{logrus.PanicLevel: 1, logrus.FatalLevel: 2, logrus.ErrorLevel: 3, logrus.InfoLevel: 6, logrus.WarnLevel: 4, logrus.DebugLevel: 7}
+var levelMap = map[logrus.Level]int32{logrus.PanicLevel: 1, logrus.FatalLevel: 2, logrus.ErrorLevel: 3, logrus.InfoLevel: 6, logrus.WarnLevel: 4, logrus.DebugLevel: 7, logrus.TraceLevel: 7}
+
+// DefaultSplitSize is the size in bytes above which full messages are split,
+// see Hook.SplitLargeMessages.
+const DefaultSplitSize = 32 * 1024
+
+// AccessLogType is the type of the access log entries, see Hook.LogTypeField.
+const AccessLogType = "access"
+
+// rfc3339Milli is time.RFC3339 with milliseconds, the precision of the GELF
+// timestamp
+const rfc3339Milli = "2006-01-02T15:04:05.000Z07:00"
+
+// Enrichment is a value computed by the hook which can be computed on the
+// logging goroutine, see Hook.CallerSideEnrichments.
+type Enrichment int
+
+const (
+	// EnrichHostname is the host name of the message
+	EnrichHostname Enrichment = iota
+	// EnrichUptime is the _uptime_seconds field, see Hook.EmitUptime
+	EnrichUptime
+)
+
+// TimePrecision is the unit of the timestamp of the messages, see
+// Hook.TimePrecision.
+type TimePrecision int
+
+const (
+	// PrecisionMilliseconds sends the number of milliseconds since the epoch
+	PrecisionMilliseconds TimePrecision = iota
+	// PrecisionSeconds sends the number of seconds since the epoch
+	PrecisionSeconds
+	// PrecisionMicroseconds sends the number of microseconds since the epoch
+	PrecisionMicroseconds
+)
+
+// timestamp returns t as a number of units since the epoch
+func (p TimePrecision) timestamp(t time.Time) int64 {
+	switch p {
+	case PrecisionSeconds:
+		return t.Unix()
+	case PrecisionMicroseconds:
+		return t.UnixNano() / int64(time.Microsecond)
+	default:
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+// jitter returns d spread by a random fraction of it, see Hook.Jitter
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return time.Duration(float64(d) * (1 + fraction*(2*mathrand.Float64()-1)))
+}
+
+// processStart is the time the process started, as the package was
+// initialized, see Hook.EmitProcessStart
+var processStart = time.Now().Format(rfc3339Milli)
+
+// LastResortFacility is the facility of the messages for which no facility
+// could be determined, so that no message is ever sent with a blank one.
+const LastResortFacility = "logrus"
+
+// CoalescedFieldMarker replaces a coalesced field value, see Hook.CoalesceEvery.
+const CoalescedFieldMarker = "<unchanged>"
 
 // Hook to send logs to a logging service compatible with the Graylog API and the GELF format.
+//
+// The settings which are also part of Config must not be changed directly
+// once the hook is in use, call Reconfigure instead. The other settings must
+// be set before the hook is in use: they can't be changed afterwards.
 type Hook struct {
-	Facility   string
-	Extra      map[string]interface{}
-	gelfLogger *gelf.Writer
-	buf        chan graylogEntry
+	Facility string
+	Extra    map[string]interface{}
+	// CoalesceEvery enables coalescing of repeated field values when > 0.
+	// A field of CoalesceFields whose string value is identical to the one
+	// sent for the same field in the previous message is replaced by
+	// CoalescedFieldMarker. The full value is sent again every
+	// CoalesceEvery messages, so the last CoalesceEvery-1 messages at most
+	// carry the marker instead of the value. Only values longer than the
+	// marker are coalesced, and numbers and booleans are never replaced, to
+	// keep the field types stable in Graylog.
+	CoalesceEvery int
+	// CoalesceFields lists the names of the fields which can be coalesced,
+	// as logged or set in Extra, typically large blobs repeated on every
+	// message. The fields computed by the hook, like the caller, the stack
+	// trace or the IDs of the messages, are never coalesced.
+	CoalesceFields []string
+	// OnBufferAlert, when set, is called once the buffer has been filled
+	// above BufferAlertThreshold (a ratio of its capacity, a full buffer
+	// when 0) for at least BufferAlertDelay. It is called only once per
+	// episode: the buffer has to go back under the threshold before it can
+	// be called again. It runs on the background goroutine, so it must not
+	// block.
+	OnBufferAlert        func(queued int, since time.Time)
+	BufferAlertThreshold float64
+	BufferAlertDelay     time.Duration
+	// TrackBuffer keeps track of the entries waiting in the buffer, for
+	// BufferSnapshot. It costs a lock and a map update per entry, so it is
+	// off by default and set with WithBufferSnapshots.
+	TrackBuffer bool
+	// MetadataField, when set, is the name of an additional field holding
+	// the facility, host and severity of the message as a JSON object, for
+	// collectors which prefer grouped metadata. The standard GELF fields
+	// are still sent.
+	MetadataField string
+	// SampledField names the field carrying the sampling decision of the
+	// trace an entry belongs to (a bool, or a string like "true" or "0").
+	// Entries of traces which were not sampled are dropped, so that the logs
+	// stored in Graylog match the stored traces. Entries without the field
+	// are always sent.
+	SampledField string
+	// SamplingDecision, when set, replaces SampledField to extract the
+	// sampling decision from an entry, for example from its context. ok is
+	// false when the entry carries no decision, in which case it is sent.
+	SamplingDecision func(entry *logrus.Entry) (sampled bool, ok bool)
+	// SampleRates sends only a fraction of the entries of the levels it
+	// lists, like 0.1 for one Info entry out of ten on average, to reduce the
+	// volume of chatty levels. The other levels, like the errors unless
+	// listed, are always sent. The dropped entries are counted, see
+	// SampledOut.
+	SampleRates map[logrus.Level]float64
+	// SampleMarkerField and SampleRateField name the fields ("sampled" and
+	// "sample_rate" when empty) of the messages kept by the sampling of
+	// their level, set to true and to the rate of the level, so that the
+	// counts can be reweighted in Graylog. They are only sent for the levels
+	// with a rate below 1 in SampleRates.
+	SampleMarkerField string
+	SampleRateField   string
+	// AlwaysDeliverLevels lists the levels of the entries which are always
+	// sent, whatever the sampling and volume reduction settings. They wait
+	// for a slot when the buffer is full, even if Blocking is false.
+	AlwaysDeliverLevels []logrus.Level
+	// OnConnectMessage, when set, is sent as is before the first message
+	// written through a connection to Graylog, for collectors expecting a
+	// handshake. It is only sent over TCP, TLS, Unix sockets and the
+	// writers of WithDialer: UDP has no connection.
+	OnConnectMessage *gelf.Message
+	// SplitLargeMessages enables the splitting of the full messages longer
+	// than SplitSize bytes (DefaultSplitSize when 0) into several messages,
+	// instead of sending them whole. The parts share the short message and
+	// the additional fields, and carry a _split_id common to all of them,
+	// their _split_index (starting at 1) and the _split_total number of
+	// parts, so the full message can be reassembled in Graylog. Without a
+	// full message, a longer short message is split the same way.
+	SplitLargeMessages bool
+	SplitSize          int
+	// PackageRoutes maps package paths (and the packages below them) to a
+	// value sent in the RouteField additional field ("route" when empty),
+	// for the entries logged from these packages. The longest matching path
+	// wins. It allows routing to streams based on the code location, without
+	// tagging every entry with a component.
+	PackageRoutes map[string]string
+	RouteField    string
+	// IgnoreCallerPaths lists path fragments, like "/vendor/": the frames of
+	// the files whose path contains one of them are skipped when looking for
+	// the caller, so that logging wrappers don't hide the code which logged.
+	IgnoreCallerPaths []string
+	// EmitRFC3339Timestamp adds the timestamp of the message in the RFC 3339
+	// format, with milliseconds, in the RFC3339TimestampField additional
+	// field ("timestamp_rfc3339" when empty). It is the same time as the
+	// GELF timestamp.
+	EmitRFC3339Timestamp  bool
+	RFC3339TimestampField string
+	// DeadLetterFile, when set, is the path of a file where the messages
+	// which couldn't be sent are written, one GELF JSON object per line, so
+	// that they can be replayed. Once it grows over DeadLetterMaxSize bytes
+	// (DefaultDeadLetterMaxSize when 0) it is rotated: the previous file is
+	// kept with a ".1" suffix.
+	DeadLetterFile    string
+	DeadLetterMaxSize int64
+	// LogTypeField names the field holding the type of the entries, for
+	// loggers used for several kinds of logs. The short message of the
+	// entries of type AccessLogType is built from their AccessLogFields
+	// ("method", "path" and "status" when empty), followed by their message
+	// if any. The other entries are sent as usual.
+	LogTypeField    string
+	AccessLogFields []string
+	// BooleansAsNumbers sends the boolean field values as 1 and 0 instead
+	// of true and false, for dashboards summing them.
+	BooleansAsNumbers bool
+	// AllowArrayFields sends the slice and array field values as JSON
+	// arrays, for the collectors supporting them. Otherwise they are sent as
+	// a string holding the JSON array, like "[1,2,3]".
+	AllowArrayFields bool
+	// EmitImage adds the _image_tag and _image_digest fields, to tell which
+	// image version produced a message. They are read when the hook is
+	// created from the ImageTagEnv and ImageDigestEnv environment variables
+	// ("IMAGE_TAG" and "IMAGE_DIGEST" when empty), so the variable names are
+	// set with WithImage. Missing variables are skipped.
+	EmitImage      bool
+	ImageTagEnv    string
+	ImageDigestEnv string
+	// IncidentIDField is the name of the field holding the incident ID set
+	// with SetIncidentID ("incident_id" when empty).
+	IncidentIDField string
+	// Minimal configures the hook for the smallest per message overhead and
+	// payload. When set, whatever the other settings:
+	//
+	//   - the _severity field is not sent (Graylog has the numeric level),
+	//   - the caller is not looked up: no file, line, function nor route,
+	//   - the stack is not walked: no stack trace (StackTraceField and
+	//     StackTraceLevels),
+	//   - the fields computed by the hook are not sent: ULID, goroutine ID,
+	//     worker, tags, RFC 3339 timestamp, syslog level, image, platform,
+	//     uptime and metadata fields, and CallerSideEnrichments is ignored.
+	//
+	// The Extra fields, the fields of the entries and of the context, the
+	// incident ID, and the markers of the sampling and of the rate limit,
+	// which tell that messages are missing, are still sent. As usual, the
+	// full message is only sent for multiline messages.
+	Minimal bool
+	// EmitUptime adds the _uptime_seconds field, the number of seconds since
+	// the hook was created, to spot problems related to the process age.
+	EmitUptime bool
+	// PrioritizeHighSeverity queues the entries at the Error level and above
+	// in a separate buffer, of the same size, which is always emptied first,
+	// so that they aren't stuck behind a flood of lower level entries. The
+	// entries of each buffer are sent in order, but high severity entries
+	// may overtake entries of lower levels logged before them. The separate
+	// buffer is allocated when the hook is created, so it is set with
+	// WithPrioritizeHighSeverity.
+	PrioritizeHighSeverity bool
+	// EmitULID adds a ULID, generated when the entry is fired, in the
+	// ULIDField field ("ulid" when empty). ULIDs sort by creation time, and
+	// the ULIDs of a hook are strictly increasing, so they give the order of
+	// the entries even when their timestamps are the same.
+	EmitULID  bool
+	ULIDField string
+	// ReservedFieldPolicy tells what to do with the fields named like the
+	// attributes of GELF messages ("host", "version", "timestamp", ...),
+	// which some collectors special-case even once prefixed. By default
+	// they are renamed with the "entry_" prefix ("host" is sent as
+	// _entry_host).
+	ReservedFieldPolicy ReservedFieldPolicy
+	// SuppressSelfLogs drops the entries logged by this package itself, to
+	// avoid feedback loops when the hook logs about itself through the
+	// logger it is added to. It relies on the caller lookup, so it has no
+	// effect in Minimal mode or with DisableCaller.
+	SuppressSelfLogs bool
+	// RollupRules aggregate the entries they match: instead of being sent,
+	// these entries are counted, and a single rollup message is sent per
+	// interval, see RollupRule.
+	RollupRules []RollupRule
+	// EmitSyslogLevel adds the level of the message, the syslog level also
+	// sent as the GELF level, in the SyslogLevelField field ("syslog_level"
+	// when empty), for numeric range queries.
+	EmitSyslogLevel  bool
+	SyslogLevelField string
+	// TimePrecision is the unit of the timestamp of the messages,
+	// milliseconds by default. go-gelf holds the timestamp as an integer, so
+	// with PrecisionSeconds the fraction of a second is dropped.
+	TimePrecision TimePrecision
+	// CallerSideEnrichments lists the enrichments computed when the entry is
+	// fired, on the goroutine which logged, instead of on the background
+	// goroutine. It is more accurate when the view of the goroutines differ
+	// (host name in namespaced setups), or for the time dependent values,
+	// at the cost of doing the work on the logging goroutine: the host name
+	// is looked up for every entry.
+	CallerSideEnrichments []Enrichment
+	// EmitPlatform adds the _goos and _goarch fields, the operating system
+	// and the architecture the program runs on.
+	EmitPlatform bool
+	// EmitGoroutineID adds the _goroutine_id field, the ID of the goroutine
+	// which logged, to debug concurrency issues. The ID is parsed from
+	// runtime.Stack when the entry is fired, which adds some overhead on the
+	// logging goroutine. IDs are reused and are not stable across restarts.
+	EmitGoroutineID bool
+	// EmptyMessagePlaceholder is the short message of the entries logged
+	// with an empty message and without error field, instead of a blank one.
+	// The entries logged with an empty message and an error field, as with
+	// logrus.WithError(err).Error(""), have the error text as short message.
+	EmptyMessagePlaceholder string
+	// WorkerID returns the ID of the worker running the goroutine which
+	// logged, sent in the _worker field when ok. It is called by Fire on the
+	// logging goroutine, as Go has no goroutine local storage: the
+	// application keeps its own mapping, for example set by each worker of a
+	// pool when it starts. It must be safe for concurrent use and fast, as it
+	// is called for every entry.
+	WorkerID func() (id string, ok bool)
+	// MaxDedupKeys bounds the number of rollups counted at once, for the
+	// rules with a Field of high cardinality (DefaultMaxDedupKeys when 0).
+	// Past it, the least recently matched rollup is sent early, so no count
+	// is lost.
+	MaxDedupKeys int
+	// MessageFieldExtractor returns fields found in the message of the
+	// entries, like KeyValueFields, to add structure to the messages of code
+	// logging free text. The fields of the entries take precedence, and the
+	// message is sent unchanged.
+	MessageFieldExtractor func(message string) map[string]interface{}
+	// FieldTypeRules coerces the values of the listed fields to a type,
+	// "string", "number" or "bool", to match the mapping of the Graylog
+	// inputs. The values which can't be coerced, like "abc" as a number, are
+	// sent unchanged.
+	FieldTypeRules map[string]string
+	// StackTraceField is the name of a field which, set to true on an entry,
+	// captures the stack trace of the caller when the entry is fired and
+	// sends it in the _stacktrace field, up to MaxStackFrames frames. The
+	// field itself isn't sent. It allows to get stack traces on demand,
+	// without the cost of capturing them for every entry.
+	StackTraceField string
+	// PackageFacilities maps package paths (and the packages below them) to
+	// the facility of the entries logged from these packages, instead of
+	// Facility. The longest matching path wins, like for PackageRoutes.
+	PackageFacilities map[string]string
+	// LevelMap overrides the syslog levels, sent as the GELF level, of the
+	// logrus levels it lists. The other levels are mapped as by default.
+	LevelMap map[logrus.Level]int32
+	// Blocking makes Fire wait for a slot in the buffer when it is full
+	// (true by default). When false, the entries fired while the buffer is
+	// full are dropped instead, so that a slow or unreachable Graylog never
+	// stalls the logging goroutines, except the entries of the
+	// AlwaysDeliverLevels.
+	Blocking bool
+	// EmitProcessStart adds the time the process started, in the RFC 3339
+	// format, in the ProcessStartField field ("process_start" when empty).
+	// Unlike the uptime, it is the same for all the messages of a process
+	// run, to group them by run and see the restarts.
+	EmitProcessStart  bool
+	ProcessStartField string
+	// Jitter spreads the timers of the hook, the intervals of the rollups and
+	// of the heartbeat, by a random fraction of their duration: with 0.1, a
+	// one minute interval lasts between 54 and 66 seconds. It avoids fleets
+	// of identical services sending to Graylog at the same time. 0 disables
+	// it.
+	Jitter float64
+	// Host is the host of the messages, instead of the host name of the
+	// machine, which is often a container ID. For example the name of the
+	// node or of the service.
+	Host string
+	// FlattenDepth is the number of levels of the map and struct values of
+	// the fields sent as separate fields, named after the field and the key
+	// joined by FlattenSeparator ("_" when empty): a "user" field holding
+	// {"id": 7} is sent as _user_id. The values nested deeper are sent as
+	// JSON strings. NewGraylogHookWithOptions sets it to DefaultFlattenDepth;
+	// 0 disables the flattening.
+	FlattenDepth     int
+	FlattenSeparator string
+	// DisableCaller skips the lookup of the caller, a walk of the stack for
+	// every entry: the messages have no file, line and function. It has the
+	// same effect on SuppressSelfLogs and PackageRoutes as Minimal.
+	DisableCaller bool
+	// FieldPrefix replaces the underscore prefixing the names of the fields
+	// of the entries, of their context and of Extra, to namespace them: with
+	// "_app_", a "user" field is sent as _app_user. It is "_" when empty. GELF
+	// requires the names of the additional fields to start with an
+	// underscore, so one is added to the prefixes without it. The fields
+	// added by the hook, like _severity, are not prefixed.
+	FieldPrefix string
+	// MaxShortLen truncates the short messages longer than MaxShortLen
+	// characters, with an ellipsis. The whole message is kept in the full
+	// message. 0 disables it.
+	MaxShortLen int
+	// StackTraceLevels lists the levels of the entries sent with the stack
+	// trace of their caller in the _stacktrace field, like with
+	// StackTraceField.
+	StackTraceLevels []logrus.Level
+	// EnabledLevels lists the levels of the entries sent to Graylog, all of
+	// them when empty: logrus doesn't fire the hook for the other levels. It
+	// can't be named Levels like the method of logrus.Hook, and must be set
+	// before the hook is added to a logger, which reads it once.
+	EnabledLevels []logrus.Level
+	// MaxRetries is the number of times the writing of a message is retried
+	// when it fails, after RetryDelay (DefaultRetryDelay when 0) doubled at
+	// each retry. Before the last retry, the hooks created with an address
+	// dial it again, to recover from a broken connection. The background
+	// goroutine waits meanwhile, so the buffer may fill up. 0 disables the
+	// retries, but the TCP, TLS and Unix socket connections are still dialed
+	// again once when a write fails.
+	MaxRetries int
+	RetryDelay time.Duration
+	// MaxReconnectsPerMinute caps the number of times the connection is
+	// dialed again, by the retries and the failover, in any minute, to
+	// protect the host from a storm of dials when the collector keeps
+	// accepting then dropping connections. The writes go on failing over
+	// the current connection meanwhile. 0 doesn't cap them. See Reconnects.
+	MaxReconnectsPerMinute int
+	// FailbackInterval is how often a hook which failed over to another
+	// address, see NewGraylogHookWithFailover, tries to dial the preferred
+	// addresses before it again, in order, to go back to the first one which
+	// can be dialed. 0 keeps the current address until it fails.
+	FailbackInterval time.Duration
+	// ContextFields maps field names to keys of values of the context of the
+	// entries (logrus.WithContext), like a request or trace ID: the values
+	// found are sent in these fields. It is a shortcut for a
+	// ContextExtractor, see RegisterContextExtractor.
+	ContextFields map[string]interface{}
+	// OnError is called with the error of the messages which couldn't be
+	// written, after the retries, on the background goroutine, and with
+	// ErrBufferFull for the entries dropped while the buffer is full, on the
+	// logging goroutine (see Blocking). It must be safe for concurrent use
+	// and return quickly, as the hook waits for it.
+	OnError func(error)
+	// IncludeSeverity sends the name of the level in the _severity field, in
+	// addition to the numeric level. The constructors set it to true; teams
+	// deriving the name from the level can unset it to save storage.
+	IncludeSeverity bool
+	// Synchronous writes the entries inline in Fire, which returns the write
+	// error, instead of sending them in the background: the message is sent
+	// when the logging call returns, at the cost of waiting for the network,
+	// for example in short-lived command line tools and in tests. Set it
+	// before adding the hook to a logger.
+	Synchronous bool
+	// MaxSynchronousSends caps the number of goroutines waiting for their
+	// entry to be written in Fire, when Synchronous, so that an error storm
+	// doesn't block every goroutine logging on the network: beyond it the
+	// entries are buffered and sent in the background, like without
+	// Synchronous. DefaultMaxSynchronousSends when 0. Set it before adding
+	// the hook to a logger.
+	MaxSynchronousSends int
+	// BatchSize makes the background goroutine take up to BatchSize entries
+	// from the buffer at once, waiting up to BatchInterval for them, and send
+	// them in a row: the locking is done once per batch. GELF has no batch
+	// format, so each entry is still written as a message of its own. The
+	// entries are sent one by one when BatchSize is 0 or 1. Set them before
+	// adding the hook to a logger.
+	BatchSize     int
+	BatchInterval time.Duration
+	// RedactKeys lists the names of the fields whose values are replaced
+	// with RedactedValue, like "password" or "authorization", compared
+	// case-insensitively. It applies to the fields of the entries, of their
+	// context and of Extra, and to the keys of the flattened values: the
+	// "password" key of a "user" map is redacted too.
+	RedactKeys []string
+	// Version is the GELF version of the messages, DefaultVersion when
+	// empty, for the sinks expecting another one.
+	Version string
+	// FacilityField names a field of the entries whose string value, when
+	// present and not empty, is the facility of the message instead of
+	// Facility and PackageFacilities, like "facility" for
+	// WithField("facility", "billing"). The field itself isn't sent.
+	FacilityField string
+	// RateLimit is the number of entries sent per second, on average, to
+	// protect Graylog from log storms, like a tight error loop: the entries
+	// beyond it are dropped, see RateLimited. Burst entries (RateLimit when
+	// 0) can be sent at once after a quiet period. 0 sends all the entries.
+	// The rollup messages and the entries of the AlwaysDeliverLevels are not
+	// limited.
+	RateLimit float64
+	Burst     int
+	// RateLimitedField and SuppressedCountField name the fields
+	// ("rate_limited" and "suppressed_count" when empty) of the first
+	// message sent after entries were dropped by the rate limit, set to true
+	// and to the number of entries dropped since the previous message.
+	RateLimitedField     string
+	SuppressedCountField string
+	// AlwaysFullMessage sends the whole message as the full message of
+	// the single line messages too, for the searches relying on it. By
+	// default, the full message is only sent for multiline messages. It has
+	// no effect in Minimal mode.
+	AlwaysFullMessage bool
+
+	mu              sync.RWMutex // guards the settings listed in Config, extractors, incidentID, heartbeat and tags
+	extractors      []ContextExtractor
+	incidentID      string
+	heartbeat       chan struct{} // closed to stop the heartbeat
+	tags            []string      // sorted, see AddTags
+	gelfLogger      MessageWriter
+	writerOptions   []func(*gelf.Writer)                     // applied to gelfLogger, see WithCompression
+	network         string                                   // "tcp" or "unix" for the stream transports, see WithTCP and WithUnix, UDP when empty
+	dialer          func(addr string) (MessageWriter, error) // see WithDialer
+	encoder         Encoder                                  // for the stream transports, see WithEncoder
+	duplicates      DuplicateHookPolicy                      // see WithDeduplicateHooks
+	tlsConfig       *tls.Config                              // see WithTLS
+	started         time.Time                                // when the hook was created
+	host            string                                   // looked up when the hook was created
+	ulids           ulidGenerator
+	bufSize         uint // see WithBufSize
+	buf             chan graylogEntry
+	highBuf         chan graylogEntry // see PrioritizeHighSeverity, nil without
+	key             string            // in hooks, empty for NewGraylogHookFromWriter
+	addrs           []string          // dialed again by redial and failover, empty for NewGraylogHookFromWriter
+	active          int               // index in addrs of the address of gelfLogger, guarded by statsMu
+	quit            chan struct{}     // closed by Close to stop fire()
+	finished        chan struct{}     // closed by fire() once stopped
+	closeOnce       sync.Once
+	closeErr        error                   // set by fire() before closing finished
+	pendingMu       sync.Mutex              // guards pending and pendingSeq
+	pending         map[uint64]pendingEntry // by graylogEntry.seq, see TrackBuffer
+	pendingSeq      uint64
+	statsMu         sync.Mutex // guards dropped, writeErrors, rateLimited, sampledOut and active
+	dropped         uint64
+	writeErrors     uint64
+	rateLimited     uint64
+	sampledOut      uint64
+	batch           []graylogEntry             // reused by fire(), see BatchSize
+	sendMu          sync.Mutex                 // held by fire() while it sends, and by Fire when Synchronous
+	coalesced       map[string]*coalescedField // guarded by sendMu
+	bufferFullSince time.Time                  // guarded by sendMu
+	bufferAlerted   bool                       // guarded by sendMu
+	connected       bool                       // guarded by sendMu
+	rollups         map[string]*rollup         // guarded by sendMu
+	rollupOrder     *list.List                 // keys of rollups, most recently matched first, guarded by sendMu
+	rollupTicker    *time.Ticker               // guarded by sendMu
+	deadLetters     *os.File                   // guarded by sendMu
+	deadLettersSize int64                      // guarded by sendMu
+	tokens          float64                    // of the rate limit, guarded by sendMu
+	tokensRefilled  time.Time                  // guarded by sendMu
+	suppressed      uint64                     // guarded by sendMu
+	reconnects      []time.Time                // guarded by sendMu, within the last minute
+	reconnectCount  uint64                     // guarded by statsMu
+	syncSlots       chan struct{}              // see synchronousSlots
+	failedBack      time.Time                  // guarded by sendMu, last failover or failback attempt
+	syncSlotsOnce   sync.Once
+	image           map[string]interface{} // see readImageFields
+}
+
+// coalescedField keeps track of the last value sent for a field
+type coalescedField struct {
+	value   string
+	skipped int
+}
+
+// Config holds the settings of a Hook which can be changed while the hook is
+// running, see Hook.Reconfigure.
+type Config struct {
+	Facility       string
+	Extra          map[string]interface{}
+	MetadataField  string
+	CoalesceEvery  int
+	CoalesceFields []string
+	LevelMap       map[logrus.Level]int32
+
+	// filters and sampling
+	RedactKeys          []string
+	SampleRates         map[logrus.Level]float64
+	AlwaysDeliverLevels []logrus.Level
+	RateLimit           float64
+	Burst               int
+
+	// enrichment
+	FieldTypeRules       map[string]string
+	EmitRFC3339Timestamp bool
+	EmitSyslogLevel      bool
+	EmitUptime           bool
+	EmitProcessStart     bool
+	EmitPlatform         bool
+	EmitULID             bool
+	EmitGoroutineID      bool
+}
+
+// ContextExtractor returns the fields to add to the messages of the entries
+// carrying ctx, see Hook.RegisterContextExtractor.
+type ContextExtractor func(ctx context.Context) map[string]interface{}
+
+// BufferSnapshot describes the entries waiting in the buffer of a Hook, see
+// Hook.BufferSnapshot.
+type BufferSnapshot struct {
+	Count    int       // number of buffered entries
+	Oldest   time.Time // when the oldest buffered entry was enqueued, zero if none
+	Messages []string  // messages of the oldest buffered entries, at most 10
+}
+
+// snapshotMessages is the maximum number of messages in a BufferSnapshot
+const snapshotMessages = 10
+
+// pendingEntry keeps track of an entry in the buffer, since the buffer
+// channel itself can't be inspected without dequeuing.
+type pendingEntry struct {
+	enqueued time.Time
+	message  string
+}
+
+// stackTraceLevel returns true for the levels listed in StackTraceLevels
+func (hook *Hook) stackTraceLevel(level logrus.Level) bool {
+	for _, l := range hook.StackTraceLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// goroutineID returns the ID of the current goroutine, parsed from the
+// "goroutine 42 [running]:" header of its stack, or 0 if it can't be parsed.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// Caller is the location of the code which logged an entry
+type Caller struct {
+	File     string
+	Line     int
+	Function string
+}
+
+// CurrentCaller returns the location of the code calling it, looked up like
+// the callers of the entries fired to the hook. It allows to test the caller
+// of the messages without hardcoding line numbers:
+//
+//	caller := graylog.CurrentCaller()
+//	log.Info("test message") // the message has caller.File and caller.Line+1
+func CurrentCaller() Caller {
+	file, line, function := getCallerIgnoringLogMulti(1, nil)
+	return Caller{file, line, function}
 }
 
 // Graylog needs file and line params
 type graylogEntry struct {
 	*logrus.Entry
-	file string
-	line int
+	file       string
+	line       int
+	function   string
+	incidentID string
+	ulid       string
+	goroutine  uint64        // 0 unless EmitGoroutineID
+	worker     string        // empty unless WorkerID
+	stack      string        // empty unless StackTraceField
+	flushed    chan struct{} // for the entries queued by Flush, closed once reached
+	host       string        // when computed by Fire
+	fired      time.Time     // when computed by Fire, for the uptime
+	sampleRate float64       // below 1 when kept by the sampling of its level
+	suppressed uint64        // entries dropped by the rate limit before it
+	seq        uint64        // in pending, 0 unless TrackBuffer
 }
 
-// NewGraylogHook creates a hook to be added to an instance of logger.
-func NewGraylogHook(addr string, facility string, extra map[string]interface{}) *Hook {
-	g, err := gelf.NewWriter(addr)
-	if err != nil {
-		logrus.WithField("err", err).Info("Can't create Gelf logger")
+// NewGraylogHook creates a hook to be added to an instance of logger. It
+// returns an error when the Gelf writer can't be created, for example when
+// addr can't be resolved. See NewGraylogHookWithOptions for more settings.
+func NewGraylogHook(addr string, facility string, extra map[string]interface{}) (*Hook, error) {
+	return NewGraylogHookWithOptions(addr, WithFacility(facility), WithExtra(extra))
+}
+
+// Flush waits until the entries fired before it are written, or until ctx is
+// done. Over UDP, it doesn't tell whether Graylog received them. The entries
+// counted in pending rollups are not sent, see Close for that.
+func (hook *Hook) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case hook.buf <- graylogEntry{flushed: flushed}:
+	case <-hook.quit:
+		return nil // Close sends the buffered entries
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-hook.finished:
 		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	hook := &Hook{
-		Facility:   facility,
-		Extra:      extra,
-		gelfLogger: g,
-		buf:        make(chan graylogEntry, BufSize),
+}
+
+// Close stops the hook: it sends the entries left in the buffer and the
+// pending rollups, stops the background goroutine and the heartbeat, then
+// closes the Gelf writer. It returns the error of closing the writer. The
+// entries fired after Close are dropped. Calling Close again does nothing.
+func (hook *Hook) Close() error {
+	hook.closeOnce.Do(func() {
+		hook.StopHeartbeat()
+		close(hook.quit)
+		<-hook.finished
+		if hook.key != "" {
+			unregisterHook(hook.key)
+		}
+	})
+	return hook.closeErr
+}
+
+// Dropped returns the number of entries dropped because the buffer was full,
+// see Blocking.
+func (hook *Hook) Dropped() uint64 {
+	hook.statsMu.Lock()
+	defer hook.statsMu.Unlock()
+	return hook.dropped
+}
+
+// SampledOut returns the number of entries dropped by the sampling of their
+// level, see Hook.SampleRates.
+func (hook *Hook) SampledOut() uint64 {
+	hook.statsMu.Lock()
+	defer hook.statsMu.Unlock()
+	return hook.sampledOut
+}
+
+// WriteErrors returns the number of messages which couldn't be written to
+// Graylog, including those saved to the DeadLetterFile. The messages which
+// couldn't be saved to the DeadLetterFile either are counted twice.
+func (hook *Hook) WriteErrors() uint64 {
+	hook.statsMu.Lock()
+	defer hook.statsMu.Unlock()
+	return hook.writeErrors
+}
+
+// Reconfigure atomically replaces the settings of the hook listed in Config,
+// for example when the configuration of the application is reloaded. The
+// buffer and the background goroutine are kept: entries already buffered are
+// sent with the new settings.
+func (hook *Hook) Reconfigure(cfg Config) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	hook.Facility = cfg.Facility
+	hook.Extra = cfg.Extra
+	hook.MetadataField = cfg.MetadataField
+	hook.CoalesceEvery = cfg.CoalesceEvery
+	hook.CoalesceFields = cfg.CoalesceFields
+	hook.LevelMap = cfg.LevelMap
+	hook.RedactKeys = cfg.RedactKeys
+	hook.SampleRates = cfg.SampleRates
+	hook.AlwaysDeliverLevels = cfg.AlwaysDeliverLevels
+	hook.RateLimit = cfg.RateLimit
+	hook.Burst = cfg.Burst
+	hook.FieldTypeRules = cfg.FieldTypeRules
+	hook.EmitRFC3339Timestamp = cfg.EmitRFC3339Timestamp
+	hook.EmitSyslogLevel = cfg.EmitSyslogLevel
+	hook.EmitUptime = cfg.EmitUptime
+	hook.EmitProcessStart = cfg.EmitProcessStart
+	hook.EmitPlatform = cfg.EmitPlatform
+	hook.EmitULID = cfg.EmitULID
+	hook.EmitGoroutineID = cfg.EmitGoroutineID
+}
+
+// RegisterContextExtractor registers a function called with the context of
+// every entry which has one, to add the fields it returns to the message. It
+// is typically used to look up a request-scoped value stored under a key of
+// the application. Extractors run on the background goroutine, after the
+// entry was logged.
+func (hook *Hook) RegisterContextExtractor(extractor ContextExtractor) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	// copy, fire() may be iterating over the current slice
+	extractors := make([]ContextExtractor, len(hook.extractors), len(hook.extractors)+1)
+	copy(extractors, hook.extractors)
+	hook.extractors = append(extractors, extractor)
+}
+
+// contextExtractors returns the registered context extractors
+func (hook *Hook) contextExtractors() []ContextExtractor {
+	hook.mu.RLock()
+	defer hook.mu.RUnlock()
+	return hook.extractors
+}
+
+// SetIncidentID adds the ID of an ongoing incident to the messages of the
+// entries logged from now on, in the IncidentIDField field, so that they can be filtered during
+// the incident. Setting an empty ID removes the field.
+func (hook *Hook) SetIncidentID(id string) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	hook.incidentID = id
+}
+
+// AddTags adds tags to the messages, sent in the _tags field, as an array
+// with AllowArrayFields or as a JSON array string otherwise. They label
+// all the messages of the process, like "canary", without managing fields.
+func (hook *Hook) AddTags(tags ...string) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	set := make(map[string]bool, len(hook.tags)+len(tags))
+	for _, tag := range hook.tags {
+		set[tag] = true
+	}
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	hook.tags = sortedTags(set)
+}
+
+// RemoveTags removes tags added with AddTags
+func (hook *Hook) RemoveTags(tags ...string) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	set := make(map[string]bool, len(hook.tags))
+	for _, tag := range hook.tags {
+		set[tag] = true
+	}
+	for _, tag := range tags {
+		delete(set, tag)
+	}
+	hook.tags = sortedTags(set)
+}
+
+// currentTags returns the tags added with AddTags. The slice must not be
+// modified.
+func (hook *Hook) currentTags() []string {
+	hook.mu.RLock()
+	defer hook.mu.RUnlock()
+	return hook.tags
+}
+
+// sortedTags returns the tags of a set, sorted
+func sortedTags(set map[string]bool) []string {
+	if len(set) == 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(set))
+	for tag := range set {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// currentIncidentID returns the ID set with SetIncidentID
+func (hook *Hook) currentIncidentID() string {
+	hook.mu.RLock()
+	defer hook.mu.RUnlock()
+	return hook.incidentID
+}
+
+// SetExtra sets a field added to all the messages, like Extra, while the
+// hook is running. The messages of the entries already buffered get it too.
+func (hook *Hook) SetExtra(key string, value interface{}) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	extra := make(map[string]interface{}, len(hook.Extra)+1)
+	for k, v := range hook.Extra {
+		extra[k] = v
+	}
+	extra[key] = value
+	hook.Extra = extra // copied, as fire() reads the previous map unlocked
+}
+
+// RemoveExtra removes a field set with SetExtra or in Extra
+func (hook *Hook) RemoveExtra(key string) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	extra := make(map[string]interface{}, len(hook.Extra))
+	for k, v := range hook.Extra {
+		if k != key {
+			extra[k] = v
+		}
+	}
+	hook.Extra = extra
+}
+
+// config returns the current settings of the hook. fire() must only access
+// them through config, once per entry.
+func (hook *Hook) config() Config {
+	hook.mu.RLock()
+	defer hook.mu.RUnlock()
+	return Config{
+		Facility:       hook.Facility,
+		Extra:          hook.Extra,
+		MetadataField:  hook.MetadataField,
+		CoalesceEvery:  hook.CoalesceEvery,
+		CoalesceFields: hook.CoalesceFields,
+		LevelMap:       hook.LevelMap,
+
+		RedactKeys:          hook.RedactKeys,
+		SampleRates:         hook.SampleRates,
+		AlwaysDeliverLevels: hook.AlwaysDeliverLevels,
+		RateLimit:           hook.RateLimit,
+		Burst:               hook.Burst,
+
+		FieldTypeRules:       hook.FieldTypeRules,
+		EmitRFC3339Timestamp: hook.EmitRFC3339Timestamp,
+		EmitSyslogLevel:      hook.EmitSyslogLevel,
+		EmitUptime:           hook.EmitUptime,
+		EmitProcessStart:     hook.EmitProcessStart,
+		EmitPlatform:         hook.EmitPlatform,
+		EmitULID:             hook.EmitULID,
+		EmitGoroutineID:      hook.EmitGoroutineID,
+	}
+}
+
+// Config returns the current settings of the hook listed in Config, to
+// change some of them with Reconfigure.
+func (hook *Hook) Config() Config {
+	return hook.config()
+}
+
+// EntryToMessage returns the message the hook sends to Graylog for an entry
+// logged from caller, without sending it. The settings applied across
+// messages (coalescing, splitting and rollups) are not applied. It allows to
+// test the messages of a hook, with a synthetic caller if needed.
+func (hook *Hook) EntryToMessage(entry *logrus.Entry, caller Caller) *gelf.Message {
+	e := graylogEntry{
+		Entry:      entry,
+		file:       caller.File,
+		line:       caller.Line,
+		function:   caller.Function,
+		incidentID: hook.currentIncidentID(),
 	}
-	go hook.fire() // Log in background
-	return hook
+	return hook.message(e, hook.config())
 }
 
 // Fire is called when a log event is fired.
 // We assume the entry will be altered by another hook,
 // otherwise we might logging something wrong to Graylog
 func (hook *Hook) Fire(entry *logrus.Entry) error {
-	// get caller file and line here, it won't be available inside the goroutine
-	// 1 for the function that called us.
-	file, line := getCallerIgnoringLogMulti(1)
-	hook.buf <- graylogEntry{entry, file, line}
+	sampleRate := 1.0
+	if !hook.alwaysDelivered(entry.Level) {
+		if !hook.traceSampled(entry) {
+			return nil
+		}
+		var sampled bool
+		if sampleRate, sampled = hook.levelSampled(entry.Level); !sampled {
+			return nil
+		}
+	}
+	var file, function string
+	var line int
+	if !hook.Minimal && !hook.DisableCaller {
+		// get caller file and line here, it won't be available inside the goroutine
+		// 1 for the function that called us.
+		file, line, function = getCallerIgnoringLogMulti(1, hook.IgnoreCallerPaths)
+		if hook.SuppressSelfLogs && selfOriginated(file) {
+			return nil
+		}
+	}
+	buf := hook.buf
+	if hook.PrioritizeHighSeverity && hook.highBuf != nil && entry.Level <= logrus.ErrorLevel {
+		buf = hook.highBuf
+	}
+	e := graylogEntry{
+		Entry:      entry,
+		file:       file,
+		line:       line,
+		function:   function,
+		incidentID: hook.currentIncidentID(),
+	}
+	if sampleRate < 1 {
+		e.sampleRate = sampleRate
+	}
+	if !hook.Minimal {
+		cfg := hook.config()
+		if cfg.EmitULID {
+			e.ulid = hook.ulids.New(time.Now())
+		}
+		if cfg.EmitGoroutineID {
+			e.goroutine = goroutineID()
+		}
+		if hook.StackTraceField != "" && entry.Data[hook.StackTraceField] == true || hook.stackTraceLevel(entry.Level) {
+			e.stack = callerStack(1, hook.IgnoreCallerPaths)
+		}
+		if hook.WorkerID != nil {
+			if id, ok := hook.WorkerID(); ok {
+				e.worker = id
+			}
+		}
+		for _, enrichment := range hook.CallerSideEnrichments {
+			switch enrichment {
+			case EnrichHostname:
+				if hook.Host == "" {
+					e.host = hostname()
+				}
+			case EnrichUptime:
+				e.fired = time.Now()
+			}
+		}
+	}
+	select {
+	case <-hook.quit:
+		return nil // closed
+	default:
+	}
+	if hook.Synchronous {
+		select {
+		case hook.synchronousSlots() <- struct{}{}:
+			defer func() { <-hook.syncSlots }()
+			return hook.fireSynchronously(e)
+		default:
+			// as many goroutines as MaxSynchronousSends are already waiting
+		}
+	}
+	hook.trackEnqueued(&e)
+	if hook.Blocking || hook.alwaysDelivered(entry.Level) {
+		select {
+		case buf <- e:
+		case <-hook.quit:
+			hook.trackDequeued(e)
+			return nil // closed while waiting for a slot, dropped
+		}
+	} else {
+		select {
+		case buf <- e:
+		default:
+			hook.trackDequeued(e)
+			hook.statsMu.Lock()
+			hook.dropped++
+			hook.statsMu.Unlock()
+			if hook.OnError != nil {
+				hook.OnError(ErrBufferFull)
+			}
+			return nil
+		}
+	}
 	return nil
 }
 
+// BufferSnapshot returns diagnostics about the entries currently waiting in
+// the buffer, without dequeuing them. It is meant for debugging a stuck
+// pipeline, and is empty unless TrackBuffer is set.
+func (hook *Hook) BufferSnapshot() BufferSnapshot {
+	hook.pendingMu.Lock()
+	defer hook.pendingMu.Unlock()
+	seqs := make([]uint64, 0, len(hook.pending))
+	for seq := range hook.pending {
+		seqs = append(seqs, seq)
+	}
+	// with PrioritizeHighSeverity, the entries aren't dequeued in order
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	snapshot := BufferSnapshot{Count: len(seqs)}
+	for i, seq := range seqs {
+		if i == 0 {
+			snapshot.Oldest = hook.pending[seq].enqueued
+		}
+		if i == snapshotMessages {
+			break
+		}
+		snapshot.Messages = append(snapshot.Messages, hook.pending[seq].message)
+	}
+	return snapshot
+}
+
+// trackEnqueued records an entry about to be sent to the buffer when
+// TrackBuffer is set, numbering it. It must be forgotten with trackDequeued
+// if it isn't sent after all.
+func (hook *Hook) trackEnqueued(entry *graylogEntry) {
+	if !hook.TrackBuffer {
+		return
+	}
+	hook.pendingMu.Lock()
+	defer hook.pendingMu.Unlock()
+	if hook.pending == nil {
+		hook.pending = map[uint64]pendingEntry{}
+	}
+	hook.pendingSeq++
+	entry.seq = hook.pendingSeq
+	hook.pending[entry.seq] = pendingEntry{time.Now(), entry.Message}
+}
+
+// trackDequeued forgets an entry recorded by trackEnqueued, received from
+// the buffer or not sent to it
+func (hook *Hook) trackDequeued(entry graylogEntry) {
+	if entry.seq == 0 {
+		return
+	}
+	hook.pendingMu.Lock()
+	defer hook.pendingMu.Unlock()
+	delete(hook.pending, entry.seq)
+}
+
+// alwaysDelivered returns true for the levels listed in AlwaysDeliverLevels
+func (hook *Hook) alwaysDelivered(level logrus.Level) bool {
+	hook.mu.RLock()
+	levels := hook.AlwaysDeliverLevels
+	hook.mu.RUnlock()
+	for _, l := range levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// levelSampled returns false for the entries dropped by the sampling of
+// their level, see Hook.SampleRates, and counts them. It returns the rate of
+// the level too, 1 when it isn't sampled.
+func (hook *Hook) levelSampled(level logrus.Level) (float64, bool) {
+	hook.mu.RLock()
+	rate, ok := hook.SampleRates[level]
+	hook.mu.RUnlock()
+	if !ok || rate >= 1 {
+		return 1, true
+	}
+	if rate > 0 && mathrand.Float64() < rate {
+		return rate, true
+	}
+	hook.statsMu.Lock()
+	hook.sampledOut++
+	hook.statsMu.Unlock()
+	return rate, false
+}
+
+// traceSampled returns false when the entry belongs to a trace which was not
+// sampled upstream, see Hook.SampledField.
+func (hook *Hook) traceSampled(entry *logrus.Entry) bool {
+	if hook.SamplingDecision != nil {
+		sampled, ok := hook.SamplingDecision(entry)
+		return sampled || !ok
+	}
+	if hook.SampledField == "" {
+		return true
+	}
+	v, ok := entry.Data[hook.SampledField]
+	if !ok {
+		return true
+	}
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		sampled, err := strconv.ParseBool(v)
+		return sampled || err != nil
+	case int:
+		return v != 0
+	}
+	return true
+}
+
 // [ks] - format based on type
 func formatForJSON(value interface{}) interface{} {
 	switch value.(type) {
-	case int:
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
 		return value
-	case float64:
+	case float32, float64, json.Number:
 		return value
 	case bool:
 		return value
 	case string:
 		return value
+	case error:
+		return value.(error).Error()
+	case fmt.Stringer:
+		return value.(fmt.Stringer).String()
 	default:
-		return fmt.Sprintf("%s", value)
+		// Slices, maps and structs are sent as JSON, which Graylog can parse,
+		// rather than as Go syntax
+		b, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprintf("%s", value)
+		}
+		var s string
+		if json.Unmarshal(b, &s) == nil {
+			return s
+		}
+		return string(b)
 	}
 }
 
+// formatValue formats a field value according to the settings of the hook
+func (hook *Hook) formatValue(value interface{}) interface{} {
+	if v := reflect.ValueOf(value); isArray(v) {
+		if hook.AllowArrayFields {
+			elems := make([]interface{}, v.Len())
+			for i := range elems {
+				elems[i] = hook.formatScalar(v.Index(i).Interface())
+			}
+			return elems
+		}
+		if b, err := json.Marshal(hook.formatElems(value)); err == nil {
+			return string(b)
+		}
+	}
+	return hook.formatScalar(value)
+}
+
+// formatElems formats the elements of an array, and of the arrays it
+// contains, to marshal it to JSON
+func (hook *Hook) formatElems(value interface{}) interface{} {
+	switch value.(type) {
+	case error, fmt.Stringer, bool:
+		return hook.formatScalar(value)
+	}
+	v := reflect.ValueOf(value)
+	if !isArray(v) {
+		return value
+	}
+	elems := make([]interface{}, v.Len())
+	for i := range elems {
+		elems[i] = hook.formatElems(v.Index(i).Interface())
+	}
+	return elems
+}
+
+// isArray tells whether a value is a slice or an array, except a byte slice
+// sent as a string
+func isArray(v reflect.Value) bool {
+	return (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() != reflect.Uint8
+}
+
+// formatScalar formats a field value which is not an array
+func (hook *Hook) formatScalar(value interface{}) interface{} {
+	value = formatForJSON(value)
+	if b, ok := value.(bool); ok && hook.BooleansAsNumbers {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	return value
+}
+
 // fire will loop on the 'buf' channel, and write entries to graylog
 func (hook *Hook) fire() {
 	for {
-		entry := <-hook.buf // receive new entry on channel
-		host, err := os.Hostname()
-		if err != nil {
-			host = "localhost"
+		entry, ok := hook.next() // receive new entry on channel
+		if !ok {
+			select {
+			case <-hook.quit:
+				hook.stop()
+				return
+			default:
+			}
+			hook.sendMu.Lock()
+			hook.safely(func() { hook.emitRollups(time.Now()) })
+			hook.sendMu.Unlock()
+			continue
+		}
+		batch := hook.collect(entry)
+		hook.sendMu.Lock()
+		for _, entry := range batch {
+			hook.safely(func() { hook.process(entry) })
+		}
+		hook.sendMu.Unlock()
+	}
+}
+
+// safely calls f, recovering from its panics so that a bad entry, like one
+// with a field whose Error method panics, doesn't stop the hook. The panics
+// are reported on stderr, as the hook can't log them.
+func (hook *Hook) safely(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "graylog: recovered from a panic while sending an entry: %v\n", r)
+		}
+	}()
+	f()
+}
+
+// process sends an entry taken from the buffer, or counts it in a rollup. It
+// must only be called with sendMu held.
+func (hook *Hook) process(entry graylogEntry) {
+	if entry.flushed != nil {
+		close(entry.flushed)
+		return
+	}
+	hook.trackDequeued(entry)
+	hook.watchBuffer()
+	if hook.rollup(entry) || !hook.allow(entry.Level, time.Now()) {
+		return
+	}
+	entry.suppressed = hook.takeSuppressed()
+	hook.send(entry)
+}
+
+// synchronousSlots returns the semaphore of the synchronous sends, see
+// MaxSynchronousSends
+func (hook *Hook) synchronousSlots() chan struct{} {
+	hook.syncSlotsOnce.Do(func() {
+		n := hook.MaxSynchronousSends
+		if n <= 0 {
+			n = DefaultMaxSynchronousSends
+		}
+		hook.syncSlots = make(chan struct{}, n)
+	})
+	return hook.syncSlots
+}
+
+// fireSynchronously sends an entry inline, see Synchronous
+func (hook *Hook) fireSynchronously(entry graylogEntry) (err error) {
+	hook.sendMu.Lock()
+	defer hook.sendMu.Unlock()
+	hook.safely(func() {
+		if !hook.rollup(entry) && hook.allow(entry.Level, time.Now()) {
+			entry.suppressed = hook.takeSuppressed()
+			err = hook.send(entry)
 		}
+	})
+	return err
+}
+
+// stop sends the entries left in the buffers and the pending rollups, then
+// closes the writer and the dead letter file. It must only be called by
+// fire().
+func (hook *Hook) stop() {
+	defer close(hook.finished)
+	hook.sendMu.Lock()
+	defer hook.sendMu.Unlock()
+drain:
+	for {
+		select {
+		case entry := <-hook.highBuf:
+			hook.safely(func() { hook.process(entry) })
+		case entry := <-hook.buf:
+			hook.safely(func() { hook.process(entry) })
+		default:
+			break drain
+		}
+	}
+	hook.safely(func() { hook.flushRollups(time.Now()) })
+	if hook.rollupTicker != nil {
+		hook.rollupTicker.Stop()
+	}
+	if hook.deadLetters != nil {
+		hook.deadLetters.Close()
+	}
+	hook.closeErr = hook.gelfLogger.Close()
+}
 
-		w := hook.gelfLogger
+// send writes an entry to graylog, returning the first error of its
+// messages. It must only be called with sendMu held.
+func (hook *Hook) send(entry graylogEntry) error {
+	cfg := hook.config()
+	m := hook.message(entry, cfg)
 
-		// remove trailing and leading whitespace
-		p := bytes.TrimSpace([]byte(entry.Message))
+	if cfg.CoalesceEvery > 0 {
+		hook.coalesce(m.Extra, entry, cfg)
+	}
 
-		// If there are newlines in the message, use the first line
-		// for the short message and set the full message to the
-		// original input.  If the input has no newlines, stick the
-		// whole thing in Short.
-		short := p
-		full := []byte("")
-		if i := bytes.IndexRune(p, '\n'); i > 0 {
-			short = p[:i]
-			full = p
+	messages := []*gelf.Message{m}
+	if hook.SplitLargeMessages {
+		messages = hook.split(m)
+	}
+
+	var firstErr error
+	for _, m := range messages {
+		// If WriteMessage failed after the retries, just give up, don't look to death
+		if err := hook.write(m); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			hook.writeFailed(err)
+			if hook.DeadLetterFile != "" {
+				if err := hook.writeDeadLetter(m); err != nil {
+					// the message is lost for good
+					hook.writeFailed(fmt.Errorf("graylog: writing the dead letter file: %w", err))
+				}
+			}
 		}
+	}
+	return firstErr
+}
+
+// writeFailed counts a message which couldn't be written and reports err to
+// OnError
+func (hook *Hook) writeFailed(err error) {
+	hook.statsMu.Lock()
+	hook.writeErrors++
+	hook.statsMu.Unlock()
+	if hook.OnError != nil {
+		hook.OnError(err)
+	}
+}
 
-		// map logrus to syslog levels
-		level, ok := levelMap[entry.Level]
-		if ok == false {
-			level = levelMap[logrus.InfoLevel]
+// message returns the GELF message of an entry
+func (hook *Hook) message(entry graylogEntry, cfg Config) *gelf.Message {
+	host := hook.Host
+	if host == "" {
+		host = entry.host
+	}
+	if host == "" {
+		host = hook.host
+	}
+	if host == "" {
+		host = hostname()
+	}
+
+	message := entry.Message
+	if hook.LogTypeField != "" && entry.Data[hook.LogTypeField] == AccessLogType {
+		message = hook.accessLogMessage(entry.Entry)
+	}
+
+	// remove trailing and leading whitespace
+	p := bytes.TrimSpace([]byte(message))
+	if len(p) == 0 {
+		p = []byte(hook.emptyMessage(entry.Entry))
+	}
+
+	// If there are newlines in the message, use the first line
+	// for the short message and set the full message to the
+	// original input.  If the input has no newlines, stick the
+	// whole thing in Short.
+	short := p
+	full := []byte("")
+	if i := bytes.IndexRune(p, '\n'); i > 0 {
+		short = p[:i]
+		full = p
+	} else if hook.AlwaysFullMessage && !hook.Minimal {
+		full = p
+	}
+	if hook.MaxShortLen > 0 && utf8.RuneCount(short) > hook.MaxShortLen {
+		short = append(truncateRunes(short, hook.MaxShortLen), "…"...)
+		full = p
+	}
+
+	// map logrus to syslog levels
+	level, ok := cfg.LevelMap[entry.Level]
+	if !ok {
+		level, ok = levelMap[entry.Level]
+	}
+	if ok == false {
+		level = levelMap[logrus.InfoLevel]
+	}
+
+	facility := cfg.Facility
+	if f, ok := packageRoute(hook.PackageFacilities, entry.function); ok {
+		facility = f
+	}
+	if hook.FacilityField != "" {
+		if f, ok := entry.Data[hook.FacilityField].(string); ok && f != "" {
+			facility = f
 		}
+	}
+	if facility == "" {
+		facility = LastResortFacility
+	}
 
-		extra := map[string]interface{}{}
+	extra := map[string]interface{}{}
 
+	if hook.IncludeSeverity && !hook.Minimal {
 		// add the logrus Level as a field in order to have the name of the level as well... I can't watch levels as numbers anymore
 		extra["_severity"] = fmt.Sprintf("%s", entry.Level)
+	}
+
+	// Merge extra fields
+	hook.addFields(extra, cfg.Extra)
+
+	// Fields from the context, the fields of the entry take precedence
+	if entry.Context != nil {
+		for _, extract := range hook.contextExtractors() {
+			hook.addFields(extra, extract(entry.Context))
+		}
+		for name, key := range hook.ContextFields {
+			if v := entry.Context.Value(key); v != nil {
+				hook.addField(extra, name, v, hook.FlattenDepth)
+			}
+		}
+	}
+
+	if hook.MessageFieldExtractor != nil {
+		hook.addFields(extra, hook.MessageFieldExtractor(entry.Message))
+	}
+
+	// Don't modify entry.Data directly, as the entry will used after this hook was fired
+	hook.addFields(extra, entry.Data)
+	hook.coerceFields(extra, cfg.FieldTypeRules)
+	for _, field := range []string{hook.StackTraceField, hook.FacilityField} {
+		if name, ok := hook.fieldName(field); ok {
+			delete(extra, name)
+		}
+	}
+	if entry.stack != "" {
+		extra["_stacktrace"] = entry.stack
+	}
+
+	if tags := hook.currentTags(); len(tags) > 0 && !hook.Minimal {
+		extra["_tags"] = hook.formatValue(tags)
+	}
+
+	if id := entry.incidentID; id != "" {
+		field := hook.IncidentIDField
+		if field == "" {
+			field = "incident_id"
+		}
+		extra["_"+field] = id
+	}
+
+	if entry.ulid != "" {
+		field := hook.ULIDField
+		if field == "" {
+			field = "ulid"
+		}
+		extra["_"+field] = entry.ulid
+	}
+
+	if entry.goroutine != 0 {
+		extra["_goroutine_id"] = entry.goroutine
+	}
+
+	if entry.worker != "" {
+		extra["_worker"] = entry.worker
+	}
+
+	if entry.function != "" {
+		extra["_func"] = entry.function
+	}
+
+	if entry.sampleRate > 0 {
+		marker, rate := hook.SampleMarkerField, hook.SampleRateField
+		if marker == "" {
+			marker = "sampled"
+		}
+		if rate == "" {
+			rate = "sample_rate"
+		}
+		extra["_"+marker] = true
+		extra["_"+rate] = entry.sampleRate
+	}
+
+	if entry.suppressed > 0 {
+		marker, count := hook.RateLimitedField, hook.SuppressedCountField
+		if marker == "" {
+			marker = "rate_limited"
+		}
+		if count == "" {
+			count = "suppressed_count"
+		}
+		extra["_"+marker] = true
+		extra["_"+count] = entry.suppressed
+	}
+
+	// The entry may have waited in the buffer: use the time it was logged
+	timestamp := entry.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	version := hook.Version
+	if version == "" {
+		version = DefaultVersion
+	}
+	m := gelf.Message{
+		Version:    version,
+		Host:       host,
+		Short:      string(short),
+		Full:       string(full),
+		TimeUnixMs: hook.TimePrecision.timestamp(timestamp),
+		Level:      level,
+		Facility:   facility,
+		File:       entry.file,
+		Line:       entry.line,
+		Extra:      extra,
+	}
+
+	if !hook.Minimal {
+		hook.enrich(&m, entry, cfg, timestamp)
+	}
+
+	return &m
+}
+
+// enrich adds the fields computed by the hook to the message of an entry,
+// see Hook.Minimal. timestamp is the time of the message.
+func (hook *Hook) enrich(m *gelf.Message, entry graylogEntry, cfg Config, timestamp time.Time) {
+	if cfg.EmitRFC3339Timestamp {
+		field := hook.RFC3339TimestampField
+		if field == "" {
+			field = "timestamp_rfc3339"
+		}
+		m.Extra["_"+field] = timestamp.Format(rfc3339Milli)
+	}
+
+	if cfg.EmitSyslogLevel {
+		field := hook.SyslogLevelField
+		if field == "" {
+			field = "syslog_level"
+		}
+		m.Extra["_"+field] = m.Level
+	}
+
+	if cfg.EmitUptime {
+		fired := entry.fired
+		if fired.IsZero() {
+			fired = timestamp
+		}
+		m.Extra["_uptime_seconds"] = int64(fired.Sub(hook.started) / time.Second)
+	}
+
+	if cfg.EmitProcessStart {
+		field := hook.ProcessStartField
+		if field == "" {
+			field = "process_start"
+		}
+		m.Extra["_"+field] = processStart
+	}
+
+	if hook.EmitImage {
+		for k, v := range hook.image {
+			m.Extra[k] = v
+		}
+	}
+
+	if cfg.EmitPlatform {
+		m.Extra["_goos"] = runtime.GOOS
+		m.Extra["_goarch"] = runtime.GOARCH
+	}
+
+	if route, ok := packageRoute(hook.PackageRoutes, entry.function); ok {
+		field := hook.RouteField
+		if field == "" {
+			field = "route"
+		}
+		m.Extra["_"+field] = route
+	}
+
+	if cfg.MetadataField != "" {
+		meta, _ := json.Marshal(map[string]string{
+			"facility": m.Facility,
+			"host":     m.Host,
+			"severity": entry.Level.String(),
+		})
+		m.Extra["_"+cfg.MetadataField] = string(meta)
+	}
+}
+
+// readImageFields returns the fields describing the image, read from the
+// tagEnv and digestEnv environment variables, see Hook.EmitImage
+func readImageFields(tagEnv, digestEnv string) map[string]interface{} {
+	image := map[string]interface{}{}
+	if tagEnv == "" {
+		tagEnv = "IMAGE_TAG"
+	}
+	if digestEnv == "" {
+		digestEnv = "IMAGE_DIGEST"
+	}
+	if v, ok := os.LookupEnv(tagEnv); ok {
+		image["_image_tag"] = v
+	}
+	if v, ok := os.LookupEnv(digestEnv); ok {
+		image["_image_digest"] = v
+	}
+	return image
+}
+
+// truncateRunes returns the first n characters of b, without splitting
+// multibyte characters. It returns a copy.
+func truncateRunes(b []byte, n int) []byte {
+	i := 0
+	for ; n > 0 && i < len(b); n-- {
+		_, size := utf8.DecodeRune(b[i:])
+		i += size
+	}
+	return append([]byte(nil), b[:i]...)
+}
+
+// emptyMessage returns the message of an entry logged with an empty message:
+// the text of its error field, or EmptyMessagePlaceholder.
+func (hook *Hook) emptyMessage(entry *logrus.Entry) string {
+	switch err := entry.Data[logrus.ErrorKey].(type) {
+	case error:
+		if msg := strings.TrimSpace(err.Error()); msg != "" {
+			return msg
+		}
+	case string:
+		if msg := strings.TrimSpace(err); msg != "" {
+			return msg
+		}
+	}
+	return hook.EmptyMessagePlaceholder
+}
+
+// accessLogMessage returns the message of an access log entry, made of its
+// AccessLogFields
+func (hook *Hook) accessLogMessage(entry *logrus.Entry) string {
+	fields := hook.AccessLogFields
+	if len(fields) == 0 {
+		fields = []string{"method", "path", "status"}
+	}
+	var parts []string
+	for _, k := range fields {
+		if v, ok := entry.Data[k]; ok {
+			parts = append(parts, fmt.Sprint(v))
+		}
+	}
+	if entry.Message != "" {
+		parts = append(parts, entry.Message)
+	}
+	return strings.Join(parts, " ")
+}
+
+// packagePath returns the path of the package of a function name as returned
+// by runtime.FuncForPC, like "github.com/sirupsen/logrus.(*Entry).Info"
+func packagePath(function string) string {
+	slash := strings.LastIndex(function, "/")
+	if dot := strings.Index(function[slash+1:], "."); dot >= 0 {
+		return function[:slash+1+dot]
+	}
+	return function
+}
 
-		// Merge extra fields
-		for k, v := range hook.Extra {
-			k = fmt.Sprintf("_%s", k) // "[...] every field you send and prefix with a _ (underscore) will be treated as an additional field."
-			extra[k] = formatForJSON(v)
+// packageRoute returns the value of the longest package path of routes
+// matching the package of function.
+func packageRoute(routes map[string]string, function string) (route string, ok bool) {
+	if len(routes) == 0 || function == "" {
+		return "", false
+	}
+	pkg := packagePath(function)
+	matched := ""
+	for prefix, r := range routes {
+		if len(prefix) < len(matched) || !(pkg == prefix || strings.HasPrefix(pkg, prefix+"/")) {
+			continue
+		}
+		matched, route, ok = prefix, r, true
+	}
+	return route, ok
+}
+
+// DefaultMaxSynchronousSends is the number of goroutines which can wait for
+// their entry to be written at once when Hook.MaxSynchronousSends is 0.
+const DefaultMaxSynchronousSends = 4
+
+// DefaultRetryDelay is the delay before the first retry when
+// Hook.RetryDelay is 0
+const DefaultRetryDelay = 100 * time.Millisecond
+
+// write writes a message, with the retries configured by MaxRetries. It must
+// only be called with sendMu held.
+func (hook *Hook) write(m *gelf.Message) error {
+	hook.failback()
+	err := hook.writeMessage(m)
+	delay := hook.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	for retry := 1; err != nil && retry <= hook.MaxRetries; retry++ {
+		time.Sleep(delay)
+		delay *= 2
+		if retry == hook.MaxRetries && len(hook.addrs) > 0 {
+			hook.redial()
+		}
+		err = hook.writeMessage(m)
+	}
+	if err != nil && hook.MaxRetries <= 0 && hook.streaming() && hook.redial() {
+		err = hook.writeMessage(m)
+	}
+	if err != nil && hook.failover() {
+		err = hook.writeMessage(m)
+	}
+	return err
+}
+
+// writeMessage writes a message, after the OnConnectMessage for the first
+// message written through a connection. It must only be called with sendMu
+// held.
+func (hook *Hook) writeMessage(m *gelf.Message) error {
+	if !hook.connected && hook.OnConnectMessage != nil && hook.connectionOriented() {
+		if err := hook.gelfLogger.WriteMessage(hook.OnConnectMessage); err != nil {
+			return err
+		}
+		hook.connected = true
+	}
+	return hook.gelfLogger.WriteMessage(m)
+}
+
+// connectionOriented tells whether the hook writes to a connection, over
+// TCP, TLS, a Unix socket or with WithDialer, which breaks for good when the
+// server goes away. It must only be called with sendMu held.
+func (hook *Hook) connectionOriented() bool {
+	_, ok := hook.gelfLogger.(*streamWriter)
+	return ok || hook.dialer != nil
+}
+
+// streaming tells whether the hook writes to a connection dialed from its
+// address, which can be dialed again. It must only be called with sendMu
+// held.
+func (hook *Hook) streaming() bool {
+	return hook.connectionOriented() && len(hook.addrs) > 0
+}
+
+// redial replaces the writer with a new one for the address of the hook,
+// keeping the current one if it fails. It returns false when it does. It
+// must only be called with sendMu held.
+func (hook *Hook) redial() bool {
+	w, err := hook.reconnect(hook.ActiveAddr())
+	if err != nil {
+		return false
+	}
+	hook.swapWriter(w)
+	return true
+}
+
+// failover replaces the writer with one for the next address which can be
+// dialed, see NewGraylogHookWithFailover. It returns false when there is
+// none. It must only be called with sendMu held.
+func (hook *Hook) failover() bool {
+	hook.statsMu.Lock()
+	active := hook.active
+	hook.statsMu.Unlock()
+	for i := 1; i < len(hook.addrs); i++ {
+		next := (active + i) % len(hook.addrs)
+		w, err := hook.reconnect(hook.addrs[next])
+		if err == errTooManyReconnects {
+			return false
+		}
+		if err != nil {
+			continue
+		}
+		hook.swapWriter(w)
+		hook.statsMu.Lock()
+		hook.active = next
+		hook.statsMu.Unlock()
+		hook.failedBack = time.Now()
+		return true
+	}
+	return false
+}
+
+// failback replaces the writer with one for the first address before the
+// active one which can be dialed, every FailbackInterval, see
+// Hook.FailbackInterval. It must only be called with sendMu held.
+func (hook *Hook) failback() {
+	if hook.FailbackInterval <= 0 || time.Since(hook.failedBack) < hook.FailbackInterval {
+		return
+	}
+	hook.statsMu.Lock()
+	active := hook.active
+	hook.statsMu.Unlock()
+	if active == 0 {
+		return
+	}
+	hook.failedBack = time.Now()
+	for i := 0; i < active; i++ {
+		w, err := hook.reconnect(hook.addrs[i])
+		if err == errTooManyReconnects {
+			return
+		}
+		if err != nil {
+			continue
 		}
+		hook.swapWriter(w)
+		hook.statsMu.Lock()
+		hook.active = i
+		hook.statsMu.Unlock()
+		return
+	}
+}
+
+// swapWriter closes the writer and replaces it with w. It must only be
+// called with sendMu held.
+func (hook *Hook) swapWriter(w MessageWriter) {
+	hook.gelfLogger.Close()
+	hook.gelfLogger = w
+	hook.connected = false
+}
 
-		// Don't modify entry.Data directly, as the entry will used after this hook was fired
-		for k, v := range entry.Data {
-			k = fmt.Sprintf("_%s", k) // "[...] every field you send and prefix with a _ (underscore) will be treated as an additional field."
-			extra[k] = formatForJSON(v)
+// ActiveAddr returns the address the hook currently sends to, which changes
+// when it fails over to another address, see NewGraylogHookWithFailover. It
+// is empty for the hooks created with NewGraylogHookFromWriter.
+func (hook *Hook) ActiveAddr() string {
+	hook.statsMu.Lock()
+	defer hook.statsMu.Unlock()
+	if len(hook.addrs) == 0 {
+		return ""
+	}
+	return hook.addrs[hook.active]
+}
+
+// split returns the parts of m when its full message, or its short message
+// when it has no full message, is too large, see Hook.SplitLargeMessages.
+func (hook *Hook) split(m *gelf.Message) []*gelf.Message {
+	size := hook.SplitSize
+	if size <= 0 {
+		size = DefaultSplitSize
+	}
+	text := m.Full
+	if text == "" {
+		text = m.Short
+	}
+	if len(text) <= size {
+		return []*gelf.Message{m}
+	}
+
+	var parts []string
+	for len(text) > 0 {
+		n := size
+		if n >= len(text) {
+			n = len(text)
+		} else {
+			// don't split a multibyte character
+			for n > 0 && !utf8.RuneStart(text[n]) {
+				n--
+			}
+			if n == 0 {
+				_, n = utf8.DecodeRuneInString(text)
+			}
+		}
+		parts = append(parts, text[:n])
+		text = text[n:]
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	messages := make([]*gelf.Message, len(parts))
+	for i, part := range parts {
+		extra := make(map[string]interface{}, len(m.Extra)+3)
+		for k, v := range m.Extra {
+			extra[k] = v
 		}
+		extra["_split_id"] = hex.EncodeToString(id)
+		extra["_split_index"] = i + 1
+		extra["_split_total"] = len(parts)
 
-		m := gelf.Message{
-			Version:    "1.1",
-			Host:       host,
-			Short:      string(short),
-			Full:       string(full),
-			TimeUnixMs: time.Now().UnixNano() / 1000000,
-			Level:      level,
-			Facility:   hook.Facility,
-			File:       entry.file,
-			Line:       entry.line,
-			Extra:      extra,
+		msg := *m
+		if m.Full != "" {
+			msg.Full = part
+		} else {
+			msg.Short = part
 		}
+		msg.Extra = extra
+		messages[i] = &msg
+	}
+	return messages
+}
 
-		w.WriteMessage(&m) // If WriteMessage failed, just give up, don't look to death
+// next returns the next entry to send, from the high severity buffer first.
+// ok is false when it's time to emit the due rollups instead.
+func (hook *Hook) next() (entry graylogEntry, ok bool) {
+	select {
+	case entry = <-hook.highBuf:
+		return entry, true
+	default:
+	}
+	select {
+	case entry = <-hook.highBuf:
+		return entry, true
+	case entry = <-hook.buf:
+		return entry, true
+	case <-hook.rollupTick():
+		return entry, false
+	case <-hook.quit:
+		return entry, false
 	}
 }
 
-// Levels returns the available logging levels. Required by logrus hook interface
+// collect returns the batch of entries starting with first, see BatchSize.
+// It stops at a Flush, so that Flush doesn't wait for BatchInterval.
+func (hook *Hook) collect(first graylogEntry) []graylogEntry {
+	hook.batch = append(hook.batch[:0], first)
+	if hook.BatchSize <= 1 || first.flushed != nil {
+		return hook.batch
+	}
+	var timeout <-chan time.Time
+	if hook.BatchInterval > 0 {
+		timer := time.NewTimer(hook.BatchInterval)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(hook.batch) < hook.BatchSize {
+		entry, ok := hook.nextInBatch(timeout)
+		if !ok {
+			break
+		}
+		hook.batch = append(hook.batch, entry)
+		if entry.flushed != nil {
+			break
+		}
+	}
+	return hook.batch
+}
+
+// nextInBatch returns the next entry of a batch, from the high severity
+// buffer first, waiting until timeout, or not at all if timeout is nil. ok is
+// false when there is none.
+func (hook *Hook) nextInBatch(timeout <-chan time.Time) (entry graylogEntry, ok bool) {
+	select {
+	case entry = <-hook.highBuf:
+		return entry, true
+	default:
+	}
+	if timeout == nil {
+		select {
+		case entry = <-hook.highBuf:
+			return entry, true
+		case entry = <-hook.buf:
+			return entry, true
+		default:
+			return entry, false
+		}
+	}
+	select {
+	case entry = <-hook.highBuf:
+		return entry, true
+	case entry = <-hook.buf:
+		return entry, true
+	case <-timeout:
+		return entry, false
+	case <-hook.quit:
+		return entry, false
+	}
+}
+
+// watchBuffer calls OnBufferAlert when one of the buffers stayed above
+// BufferAlertThreshold for longer than BufferAlertDelay.
+func (hook *Hook) watchBuffer() {
+	if hook.OnBufferAlert == nil {
+		return
+	}
+	threshold := hook.BufferAlertThreshold
+	if threshold <= 0 || threshold > 1 {
+		threshold = 1
+	}
+	above := func(buf chan graylogEntry) bool {
+		return cap(buf) > 0 && float64(len(buf)) >= threshold*float64(cap(buf))
+	}
+	queued := len(hook.buf) + len(hook.highBuf)
+	if !above(hook.buf) && !above(hook.highBuf) {
+		// occupancy recovered, next episode can be reported
+		hook.bufferFullSince = time.Time{}
+		hook.bufferAlerted = false
+		return
+	}
+	now := time.Now()
+	if hook.bufferFullSince.IsZero() {
+		hook.bufferFullSince = now
+	}
+	if !hook.bufferAlerted && now.Sub(hook.bufferFullSince) >= hook.BufferAlertDelay {
+		hook.bufferAlerted = true
+		hook.OnBufferAlert(queued, hook.bufferFullSince)
+	}
+}
+
+// coalesce replaces the values of the fields of extra listed in
+// cfg.CoalesceFields which didn't change since the last message with
+// CoalescedFieldMarker, see Hook.CoalesceEvery.
+func (hook *Hook) coalesce(extra map[string]interface{}, entry graylogEntry, cfg Config) {
+	// Only consecutive messages can be coalesced: forget about the fields
+	// the current message doesn't carry.
+	coalesced := make(map[string]*coalescedField, len(cfg.CoalesceFields))
+	for _, field := range cfg.CoalesceFields {
+		// only the fields of the application, not those of the hook
+		_, logged := entry.Data[field]
+		if _, ok := cfg.Extra[field]; !ok && !logged {
+			continue
+		}
+		k, ok := hook.fieldName(field)
+		if !ok {
+			continue
+		}
+		str, ok := extra[k].(string)
+		if !ok || len(str) <= len(CoalescedFieldMarker) {
+			continue
+		}
+		prev, ok := hook.coalesced[k]
+		if !ok || prev.value != str || prev.skipped+1 >= cfg.CoalesceEvery {
+			coalesced[k] = &coalescedField{value: str}
+			continue
+		}
+		prev.skipped++
+		coalesced[k] = prev
+		extra[k] = CoalescedFieldMarker
+	}
+	hook.coalesced = coalesced
+}
+
+// Levels returns the available logging levels, or EnabledLevels if set.
+// Required by logrus hook interface
 func (hook *Hook) Levels() []logrus.Level {
+	if len(hook.EnabledLevels) > 0 {
+		return hook.EnabledLevels
+	}
 	return []logrus.Level{
 		logrus.PanicLevel,
 		logrus.FatalLevel,
@@ -161,40 +2153,99 @@ func (hook *Hook) Levels() []logrus.Level {
 		logrus.WarnLevel,
 		logrus.InfoLevel,
 		logrus.DebugLevel,
+		logrus.TraceLevel,
+	}
+}
+
+// hostname returns the host name of the machine, "localhost" if unknown
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "localhost"
 	}
+	return host
 }
 
-// getCaller returns the filename and the line info of a function
+// packageDir is the directory of the source files of this package
+var packageDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+// selfOriginated returns true when file is one of the source files of this
+// package, tests excluded.
+func selfOriginated(file string) bool {
+	return filepath.Dir(file) == packageDir && !strings.HasSuffix(file, "_test.go")
+}
+
+// getCaller returns the filename, the line info and the name of a function
 // further down in the call stack.  Passing 0 in as callDepth would
-// return info on the function calling getCallerIgnoringLog, 1 the
-// parent function, and so on.  Any suffixes passed to getCaller are
-// path fragments like "/pkg/log/log.go", and functions in the call
-// stack from that file are ignored.
-func getCaller(callDepth int, suffixesToIgnore ...string) (file string, line int) {
-	// bump by 1 to ignore the getCaller (this) stackframe
-	callDepth++
-outer:
-	for {
-		var ok bool
-		_, file, line, ok = runtime.Caller(callDepth)
-		if !ok {
-			file = "???"
-			line = 0
-			break
+// return info on the function calling getCaller, 1 the parent function, and
+// so on.  The frames skipped to find the caller are those of ignoredFrame.
+func getCaller(callDepth int, substringsToIgnore []string) (file string, line int, function string) {
+	pcs := make([]uintptr, 2*MaxStackFrames)
+	// the +2 is to ignore the runtime.Callers and getCaller frames
+	n := runtime.Callers(callDepth+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for more := n > 0; more; {
+		var frame runtime.Frame
+		frame, more = frames.Next()
+		if !ignoredFrame(frame, substringsToIgnore) {
+			return frame.File, frame.Line, frame.Function
 		}
+	}
+	return "???", 0, ""
+}
 
-		for _, s := range suffixesToIgnore {
-			if strings.HasSuffix(file, s) {
-				callDepth++
-				continue outer
-			}
+func getCallerIgnoringLogMulti(callDepth int, substringsToIgnore []string) (string, int, string) {
+	// the +1 is to ignore this (getCallerIgnoringLogMulti) frame
+	return getCaller(callDepth+1, substringsToIgnore)
+}
+
+// logrusPackage is the package of the functions of the frames between the
+// caller and the hook
+const logrusPackage = "github.com/sirupsen/logrus"
+
+// MaxStackFrames is the number of frames of the stack traces, see
+// Hook.StackTraceField.
+const MaxStackFrames = 32
+
+// callerStack returns the stack trace of the caller found like
+// getCallerIgnoringLogMulti, formatted like the stack traces of panics.
+func callerStack(callDepth int, substringsToIgnore []string) string {
+	pcs := make([]uintptr, 2*MaxStackFrames)
+	// the +2 is to ignore the runtime.Callers and callerStack frames
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(callDepth+2, pcs)])
+	var b strings.Builder
+	caller, n := false, 0
+	for n < MaxStackFrames {
+		frame, more := frames.Next()
+		if caller || !ignoredFrame(frame, substringsToIgnore) {
+			caller = true
+			fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+			n++
+		}
+		if !more {
+			break
 		}
-		break
 	}
-	return
+	return b.String()
 }
 
-func getCallerIgnoringLogMulti(callDepth int) (string, int) {
-	// the +1 is to ignore this (getCallerIgnoringLogMulti) frame
-	return getCaller(callDepth+1, "logrus/hooks.go", "logrus/entry.go", "logrus/logger.go", "logrus/exported.go", "asm_amd64.s")
+// ignoredFrame returns true for the frames skipped to find the caller: those
+// of logrus, vendored or not, whatever the path of its files, and those of
+// the files whose path contains one of substringsToIgnore.
+func ignoredFrame(frame runtime.Frame, substringsToIgnore []string) bool {
+	if pkg := packagePath(frame.Function); pkg == logrusPackage || strings.HasSuffix(pkg, "/vendor/"+logrusPackage) {
+		return true
+	}
+	if strings.HasSuffix(frame.File, "asm_amd64.s") {
+		return true
+	}
+	for _, s := range substringsToIgnore {
+		if strings.Contains(frame.File, s) {
+			return true
+		}
+	}
+	return false
 }
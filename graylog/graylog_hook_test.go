@@ -1,15 +1,42 @@
 package graylog
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/alfatraining/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
 )
 
 const SyslogInfoLevel = 6
 
+// newTestHook returns a hook of the "test_facility" facility with the
+// settings of opts, closed at the end of the test, and the reader of the
+// messages it sends
+func newTestHook(t *testing.T, opts ...Option) (*Hook, *gelf.Reader) {
+	r, err := gelf.NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	hook, err := NewGraylogHookWithOptions(r.Addr(), append([]Option{WithFacility("test_facility")}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	t.Cleanup(func() { hook.Close() })
+	return hook, r
+}
+
 type CustomTypeStringer struct {
 }
 
@@ -18,16 +45,13 @@ func (c CustomTypeStringer) String() string {
 }
 
 func TestWritingToUDP(t *testing.T) {
-	r, err := gelf.NewReader("127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("NewReader: %s", err)
-	}
-	hook := NewGraylogHook(r.Addr(), "test_facility", map[string]interface{}{"foo": "bar"})
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{"foo": "bar"}))
 	msgData := "test message\nsecond line"
 	ct := &CustomTypeStringer{}
 
 	log := logrus.New()
 	log.Hooks.Add(hook)
+	caller := CurrentCaller()
 	log.WithFields(logrus.Fields{"withField": "1", "custom": ct}).Info(msgData)
 
 	msg, err := r.ReadMessage()
@@ -58,16 +82,16 @@ func TestWritingToUDP(t *testing.T) {
 			msg.File)
 	}
 
-	if msg.Line != 31 { // Update this if code is updated above
-		t.Errorf("msg.Line: expected %d, got %d", 25, msg.Line)
+	if msg.Line != caller.Line+1 {
+		t.Errorf("msg.Line: expected %d, got %d", caller.Line+1, msg.Line)
 	}
 
-	const expectedExtraFields = 4
+	const expectedExtraFields = 5
 	if len(msg.Extra) != expectedExtraFields {
 		t.Errorf("wrong number of extra fields (exp: %d, got %d) in %v", expectedExtraFields, len(msg.Extra), msg.Extra)
 	}
 
-	extra := map[string]string{"foo": "bar", "withField": "1", "custom": ct.String()}
+	extra := map[string]string{"foo": "bar", "withField": "1", "custom": ct.String(), "func": caller.Function}
 
 	for k, v := range extra {
 		// Remember extra fileds are prefixed with "_"
@@ -80,3 +104,1900 @@ func TestWritingToUDP(t *testing.T) {
 		}
 	}
 }
+
+func TestCoalesceFields(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.CoalesceEvery = 2
+	hook.CoalesceFields = []string{"config", "func"}
+	blob := strings.Repeat("config", 20)
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+
+	expected := []string{blob, CoalescedFieldMarker, blob}
+	for range expected {
+		log.WithFields(logrus.Fields{"config": blob, "other": blob}).Info("test message")
+	}
+
+	for i, exp := range expected {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Extra["_config"] != exp {
+			t.Errorf("message %d: expected _config to be %#v, got %#v", i, exp, msg.Extra["_config"])
+		}
+		if msg.Extra["_other"] != blob {
+			t.Errorf("message %d: expected _other not to be coalesced, got %#v", i, msg.Extra["_other"])
+		}
+		if msg.Extra["_func"] == CoalescedFieldMarker {
+			t.Errorf("message %d: expected _func, computed by the hook, not to be coalesced", i)
+		}
+	}
+}
+
+func TestBufferAlert(t *testing.T) {
+	alerts := 0
+	hook := &Hook{
+		buf:                  make(chan graylogEntry, 4),
+		BufferAlertThreshold: 0.5,
+		OnBufferAlert: func(queued int, since time.Time) {
+			alerts++
+		},
+	}
+
+	hook.buf <- graylogEntry{}
+	hook.watchBuffer()
+	if alerts != 0 {
+		t.Errorf("expected no alert under the threshold, got %d", alerts)
+	}
+
+	hook.buf <- graylogEntry{}
+	hook.watchBuffer()
+	hook.watchBuffer()
+	if alerts != 1 {
+		t.Errorf("expected 1 alert for the episode, got %d", alerts)
+	}
+
+	<-hook.buf
+	hook.watchBuffer() // recovered
+	hook.buf <- graylogEntry{}
+	hook.watchBuffer()
+	if alerts != 2 {
+		t.Errorf("expected a new alert after recovery, got %d", alerts)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{"foo": "bar"}))
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+
+	hook.Reconfigure(Config{
+		Facility:       "new_facility",
+		Extra:          map[string]interface{}{"baz": "qux"},
+		LevelMap:       map[logrus.Level]int32{logrus.InfoLevel: 5},
+		RedactKeys:     []string{"password"},
+		FieldTypeRules: map[string]string{"count": "string"},
+	})
+	cfg := hook.Config()
+	cfg.EmitPlatform = true
+	hook.Reconfigure(cfg)
+	log.WithFields(logrus.Fields{"password": "secret", "count": 3}).Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Facility != "new_facility" {
+		t.Errorf("msg.Facility: expected %#v, got %#v", "new_facility", msg.Facility)
+	}
+	if msg.Level != 5 {
+		t.Errorf("msg.Level: expected 5, got %d", msg.Level)
+	}
+	if _, ok := msg.Extra["_foo"]; ok {
+		t.Errorf("Expected extra '_foo' to be removed, got %#v", msg.Extra["_foo"])
+	}
+	if msg.Extra["_baz"] != "qux" {
+		t.Errorf("Expected extra '_baz' to be %#v, got %#v", "qux", msg.Extra["_baz"])
+	}
+	if msg.Extra["_password"] != RedactedValue {
+		t.Errorf("Expected extra '_password' to be redacted, got %#v", msg.Extra["_password"])
+	}
+	if msg.Extra["_count"] != "3" {
+		t.Errorf("Expected extra '_count' to be %#v, got %#v", "3", msg.Extra["_count"])
+	}
+	if msg.Extra["_goos"] != runtime.GOOS {
+		t.Errorf("Expected extra '_goos' to be %#v, got %#v", runtime.GOOS, msg.Extra["_goos"])
+	}
+}
+
+func TestSampledField(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.SampledField = "sampled"
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.WithField("sampled", false).Info("not sampled")
+	log.WithField("sampled", "false").Info("not sampled either")
+	log.WithField("sampled", true).Info("sampled")
+	log.Info("no decision")
+
+	for _, expected := range []string{"sampled", "no decision"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %#v, got %#v", expected, msg.Short)
+		}
+	}
+}
+
+func TestAlwaysDeliverLevels(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.SampledField = "sampled"
+	hook.SampleRates = map[logrus.Level]float64{logrus.ErrorLevel: 0}
+	hook.AlwaysDeliverLevels = []logrus.Level{logrus.ErrorLevel}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.WithField("sampled", false).Info("not sampled")
+	log.WithField("sampled", false).Error("delivered anyway")
+	log.Info("no decision")
+	log.Error("not sampled by level")
+
+	for _, expected := range []string{"delivered anyway", "no decision", "not sampled by level"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %#v, got %#v", expected, msg.Short)
+		}
+	}
+}
+
+func TestEmptyFacility(t *testing.T) {
+	hook, r := newTestHook(t, WithFacility(""), WithExtra(map[string]interface{}{}))
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Facility != LastResortFacility {
+		t.Errorf("msg.Facility: expected %#v, got %#v", LastResortFacility, msg.Facility)
+	}
+}
+
+func TestBufferSnapshot(t *testing.T) {
+	// no background goroutine: entries stay in the buffer
+	hook := &Hook{buf: make(chan graylogEntry, 20), TrackBuffer: true}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	for i := 0; i < 12; i++ {
+		log.Infof("message %d", i)
+	}
+
+	snapshot := hook.BufferSnapshot()
+	if snapshot.Count != 12 {
+		t.Errorf("snapshot.Count: expected %d, got %d", 12, snapshot.Count)
+	}
+	if snapshot.Oldest.IsZero() {
+		t.Errorf("snapshot.Oldest: expected a time, got zero")
+	}
+	if len(snapshot.Messages) != 10 || snapshot.Messages[0] != "message 0" {
+		t.Errorf("snapshot.Messages: expected the 10 first messages, got %#v", snapshot.Messages)
+	}
+	if len(hook.buf) != 12 {
+		t.Errorf("expected the buffer to be left untouched, got %d entries", len(hook.buf))
+	}
+
+	// entries dequeued out of order, like with PrioritizeHighSeverity
+	<-hook.buf
+	second := <-hook.buf
+	hook.trackDequeued(second)
+	snapshot = hook.BufferSnapshot()
+	if snapshot.Count != 11 || snapshot.Messages[0] != "message 0" || snapshot.Messages[1] != "message 2" {
+		t.Errorf("expected message 1 to be removed, got %d entries: %#v", snapshot.Count, snapshot.Messages)
+	}
+
+	untracked := &Hook{buf: make(chan graylogEntry, 20)}
+	log = logrus.New()
+	log.Hooks.Add(untracked)
+	log.Info("test message")
+	if snapshot := untracked.BufferSnapshot(); snapshot.Count != 0 {
+		t.Errorf("expected no snapshot without TrackBuffer, got %d entries", snapshot.Count)
+	}
+}
+
+func TestOnConnectMessage(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	r := newTCPReader(t, l)
+	defer r.Close()
+	hook, err := NewGraylogHookWithOptions(l.Addr().String(), WithTCP())
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	hook.OnConnectMessage = &gelf.Message{Version: "1.1", Host: "test", Short: "hello"}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("first")
+	log.Info("second")
+
+	for _, expected := range []string{"hello", "first", "second"} {
+		if msg := r.ReadMessage(t); msg.Short != expected {
+			t.Errorf("msg.Short: expected %#v, got %#v", expected, msg.Short)
+		}
+	}
+}
+
+func TestSplitLargeMessages(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.SplitLargeMessages = true
+	hook.SplitSize = 100
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	msgData := "test message\n" + strings.Repeat("0123456789", 24)
+	log.Info(msgData)
+
+	var id interface{}
+	var full string
+	for i := 1; i <= 3; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != "test message" {
+			t.Errorf("msg.Short: expected %#v, got %#v", "test message", msg.Short)
+		}
+		if i == 1 {
+			id = msg.Extra["_split_id"]
+		} else if msg.Extra["_split_id"] != id {
+			t.Errorf("Expected _split_id to be %#v, got %#v", id, msg.Extra["_split_id"])
+		}
+		// numbers are decoded as float64
+		if msg.Extra["_split_index"] != float64(i) || msg.Extra["_split_total"] != float64(3) {
+			t.Errorf("Expected part %d/3, got %v/%v", i, msg.Extra["_split_index"], msg.Extra["_split_total"])
+		}
+		full += msg.Full
+	}
+	if full != msgData {
+		t.Errorf("reassembled msg.Full: expected %#v, got %#v", msgData, full)
+	}
+}
+
+func TestSplitLargeShortMessages(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.SplitLargeMessages = true
+	hook.SplitSize = 100
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	msgData := strings.Repeat("0123456789", 25)
+	log.Info(msgData)
+
+	var short string
+	for i := 1; i <= 3; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Full != "" {
+			t.Errorf("msg.Full: expected none, got %#v", msg.Full)
+		}
+		if len(msg.Short) > 100 {
+			t.Errorf("msg.Short: expected at most 100 bytes, got %d", len(msg.Short))
+		}
+		if msg.Extra["_split_index"] != float64(i) || msg.Extra["_split_total"] != float64(3) {
+			t.Errorf("Expected part %d/3, got %v/%v", i, msg.Extra["_split_index"], msg.Extra["_split_total"])
+		}
+		short += msg.Short
+	}
+	if short != msgData {
+		t.Errorf("reassembled msg.Short: expected %#v, got %#v", msgData, short)
+	}
+}
+
+type requestKey struct{}
+
+type request struct {
+	ID   string
+	User string
+}
+
+func TestContextExtractor(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.RegisterContextExtractor(func(ctx context.Context) map[string]interface{} {
+		req, ok := ctx.Value(requestKey{}).(*request)
+		if !ok {
+			return nil
+		}
+		return map[string]interface{}{"request_id": req.ID, "user": req.User}
+	})
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	ctx := context.WithValue(context.Background(), requestKey{}, &request{ID: "42", User: "alice"})
+	log.WithContext(ctx).WithField("user", "bob").Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_request_id"] != "42" {
+		t.Errorf("Expected extra '_request_id' to be %#v, got %#v", "42", msg.Extra["_request_id"])
+	}
+	if msg.Extra["_user"] != "bob" {
+		t.Errorf("Expected the entry field '_user' to win, got %#v", msg.Extra["_user"])
+	}
+}
+
+func TestPackageRoutes(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.PackageRoutes = map[string]string{
+		"github.com/alfatraining":                      "alfatraining",
+		"github.com/alfatraining/logrus-hooks/graylog": "graylog",
+		"github.com/alfatraining/logrus-hooks/gray":    "gray",
+	}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_route"] != "graylog" {
+		t.Errorf("Expected extra '_route' to be %#v, got %#v", "graylog", msg.Extra["_route"])
+	}
+}
+
+func TestIgnoreCallerPaths(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	logThroughWrapper(log, "test message")
+	hook.IgnoreCallerPaths = []string{"/vendored_wrapper"}
+	logThroughWrapper(log, "test message")
+
+	for _, fileExpected := range []string{"vendored_wrapper_test.go", "graylog_hook_test.go"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if !strings.HasSuffix(msg.File, fileExpected) {
+			t.Errorf("msg.File: expected %s, got %s", fileExpected, msg.File)
+		}
+	}
+}
+
+func TestAccessLogType(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.LogTypeField = "type"
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.WithFields(logrus.Fields{"type": "access", "method": "GET", "path": "/status", "status": 200}).Info("")
+	log.WithFields(logrus.Fields{"type": "app", "method": "GET"}).Info("test message")
+
+	for _, expected := range []string{"GET /status 200", "test message"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %#v, got %#v", expected, msg.Short)
+		}
+	}
+}
+
+func TestBooleansAsNumbers(t *testing.T) {
+	for _, test := range []struct {
+		numbers bool
+		yes, no interface{}
+	}{
+		{false, true, false},
+		// numbers are decoded as float64
+		{true, float64(1), float64(0)},
+	} {
+		// set before the hook starts, as the fields aren't guarded
+		hook, r := newTestHook(t, WithExtra(map[string]interface{}{}), func(hook *Hook) {
+			hook.BooleansAsNumbers = test.numbers
+		})
+
+		log := logrus.New()
+		log.Hooks.Add(hook)
+		log.WithFields(logrus.Fields{"yes": true, "no": false}).Info("test message")
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Extra["_yes"] != test.yes || msg.Extra["_no"] != test.no {
+			t.Errorf("BooleansAsNumbers %t: expected %#v and %#v, got %#v and %#v", test.numbers, test.yes, test.no, msg.Extra["_yes"], msg.Extra["_no"])
+		}
+	}
+}
+
+func TestSetIncidentID(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	hook.SetIncidentID("INC-42")
+	log.Info("during the incident")
+	hook.SetIncidentID("")
+	log.Info("after the incident")
+
+	for _, expected := range []interface{}{"INC-42", nil} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Extra["_incident_id"] != expected {
+			t.Errorf("Expected extra '_incident_id' to be %#v, got %#v", expected, msg.Extra["_incident_id"])
+		}
+	}
+}
+
+func TestMinimal(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{"foo": "bar"}))
+	hook.Minimal = true
+	hook.EmitRFC3339Timestamp = true
+	hook.EmitULID = true
+	hook.EmitGoroutineID = true
+	hook.StackTraceField = "capture_stack"
+	hook.StackTraceLevels = []logrus.Level{logrus.InfoLevel}
+	hook.WorkerID = func() (string, bool) { return "worker-1", true }
+	hook.AddTags("canary")
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.WithField("capture_stack", true).Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.File != "" || msg.Line != 0 {
+		t.Errorf("Expected no caller, got %s:%d", msg.File, msg.Line)
+	}
+	if len(msg.Extra) != 1 || msg.Extra["_foo"] != "bar" {
+		t.Errorf("Expected only the '_foo' extra field, got %v", msg.Extra)
+	}
+}
+
+func TestIncludeSeverity(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+	entry.Level = logrus.WarnLevel
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_severity"] != "warning" {
+		t.Errorf("_severity: expected %#v, got %#v", "warning", msg.Extra["_severity"])
+	}
+
+	hook.IncludeSeverity = false
+	msg := hook.EntryToMessage(entry, Caller{})
+	if v, ok := msg.Extra["_severity"]; ok {
+		t.Errorf("_severity: expected none, got %#v", v)
+	}
+	if msg.Level != 4 {
+		t.Errorf("Level: expected 4, got %d", msg.Level)
+	}
+}
+
+func TestPrioritizeHighSeverity(t *testing.T) {
+	// no background goroutine yet: entries stay in the buffers
+	hook := &Hook{
+		buf:                    make(chan graylogEntry, 10),
+		highBuf:                make(chan graylogEntry, 10),
+		PrioritizeHighSeverity: true,
+	}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("first info")
+	log.Error("error")
+	log.Info("second info")
+
+	for _, expected := range []string{"error", "first info", "second info"} {
+		if entry, _ := hook.next(); entry.Message != expected {
+			t.Errorf("expected %#v, got %#v", expected, entry.Message)
+		}
+	}
+}
+
+func TestSelfOriginated(t *testing.T) {
+	_, testFile, _, _ := runtime.Caller(0)
+	hookFile := filepath.Join(filepath.Dir(testFile), "graylog_hook.go")
+
+	if !selfOriginated(hookFile) {
+		t.Errorf("expected %s to be part of the package", hookFile)
+	}
+	if selfOriginated(testFile) {
+		t.Errorf("expected tests not to be part of the package")
+	}
+	if selfOriginated("/go/src/github.com/sirupsen/logrus/entry.go") {
+		t.Errorf("expected logrus not to be part of the package")
+	}
+}
+
+func TestAllowArrayFields(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.WithField("tags", []string{"a", "b"}).Info("test message")
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_tags"] != `["a","b"]` {
+		t.Errorf("Expected extra '_tags' to be %#v, got %#v", `["a","b"]`, msg.Extra["_tags"])
+	}
+
+	hook, r = newTestHook(t, WithExtra(map[string]interface{}{}), allowArrayFields)
+	log = logrus.New()
+	log.Hooks.Add(hook)
+	log.WithField("tags", []string{"a", "b"}).Info("test message")
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	tags, ok := msg.Extra["_tags"].([]interface{})
+	if !ok || len(tags) != 2 || tags[0] != "a" || tags[1] != "b" {
+		t.Errorf("Expected extra '_tags' to be an array of a and b, got %#v", msg.Extra["_tags"])
+	}
+}
+
+// allowArrayFields sets AllowArrayFields before the hook starts, as the
+// fields aren't guarded
+func allowArrayFields(hook *Hook) {
+	hook.AllowArrayFields = true
+}
+
+func TestCompositeFieldValues(t *testing.T) {
+	type user struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	if v := formatForJSON([]int{1, 2, 3}); v != "[1,2,3]" {
+		t.Errorf("[]int: expected %#v, got %#v", "[1,2,3]", v)
+	}
+	if v := formatForJSON(user{7, "alice"}); v != `{"id":7,"name":"alice"}` {
+		t.Errorf("struct: expected %#v, got %#v", `{"id":7,"name":"alice"}`, v)
+	}
+	if v := formatForJSON(func() {}); v == "" {
+		t.Error("func: expected the fallback to fmt, got an empty string")
+	}
+
+	hook, _ := newTestHook(t)
+	hook.FlattenDepth = 0
+	msg := hook.EntryToMessage(logrus.WithFields(logrus.Fields{
+		"user":   user{7, "alice"},
+		"ids":    []int{1, 2, 3},
+		"matrix": [][]int{{1, 2}, {3}},
+	}), Caller{})
+	expected := map[string]interface{}{
+		"_user":   `{"id":7,"name":"alice"}`,
+		"_ids":    "[1,2,3]",
+		"_matrix": "[[1,2],[3]]",
+	}
+	for k, v := range expected {
+		if msg.Extra[k] != v {
+			t.Errorf("%s: expected %#v, got %#v", k, v, msg.Extra[k])
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Version != DefaultVersion {
+		t.Errorf("msg.Version: expected %#v, got %#v", DefaultVersion, msg.Version)
+	}
+	hook.Version = "1.0"
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Version != "1.0" {
+		t.Errorf("msg.Version: expected %#v, got %#v", "1.0", msg.Version)
+	}
+}
+
+func TestFacilityField(t *testing.T) {
+	hook, _ := newTestHook(t)
+	hook.FacilityField = "facility"
+
+	msg := hook.EntryToMessage(logrus.WithField("facility", "billing"), Caller{})
+	if msg.Facility != "billing" {
+		t.Errorf("msg.Facility: expected %#v, got %#v", "billing", msg.Facility)
+	}
+	for _, k := range []string{"_facility", "_entry_facility"} {
+		if v, ok := msg.Extra[k]; ok {
+			t.Errorf("%s: expected none, got %#v", k, v)
+		}
+	}
+
+	msg = hook.EntryToMessage(logrus.WithField("foo", "bar"), Caller{})
+	if msg.Facility != "test_facility" {
+		t.Errorf("msg.Facility: expected %#v, got %#v", "test_facility", msg.Facility)
+	}
+}
+
+func TestSampleRates(t *testing.T) {
+	hook, r := newTestHook(t)
+	const warnRate = 0.9999999
+	hook.SampleRates = map[logrus.Level]float64{logrus.InfoLevel: 0, logrus.DebugLevel: 1, logrus.WarnLevel: warnRate}
+	hook.SampleMarkerField = "kept"
+	hook.SampleRateField = "rate"
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Level = logrus.DebugLevel
+	log.Hooks.Add(hook)
+
+	for i := 0; i < 10; i++ {
+		log.Info("sampled out")
+	}
+	log.Debug("debug message")
+	log.Error("error message")
+	log.Warn("warn message")
+
+	for _, expected := range []string{"debug message", "error message"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %#v, got %#v", expected, msg.Short)
+		}
+		for _, field := range []string{"_kept", "_rate", "_sampled", "_sample_rate"} {
+			if _, ok := msg.Extra[field]; ok {
+				t.Errorf("%s: expected none for %#v, got %#v", field, expected, msg.Extra[field])
+			}
+		}
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_kept"] != true || msg.Extra["_rate"] != warnRate {
+		t.Errorf("expected _kept and a _rate of %v, got %v", warnRate, msg.Extra)
+	}
+	for _, field := range []string{"_sampled", "_sample_rate"} {
+		if _, ok := msg.Extra[field]; ok {
+			t.Errorf("%s: expected the custom names only, got %v", field, msg.Extra)
+		}
+	}
+	if n := hook.SampledOut(); n != 10 {
+		t.Errorf("SampledOut: expected 10, got %d", n)
+	}
+}
+
+func TestAlwaysFullMessage(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+	entry.Message = "  single line  "
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Short != "single line" || msg.Full != "" {
+		t.Errorf("expected only the short message, got %#v and %#v", msg.Short, msg.Full)
+	}
+
+	hook.AlwaysFullMessage = true
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Short != "single line" || msg.Full != "single line" {
+		t.Errorf("expected the message as short and full message, got %#v and %#v", msg.Short, msg.Full)
+	}
+
+	hook.Minimal = true
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Short != "single line" || msg.Full != "" {
+		t.Errorf("expected only the short message in Minimal mode, got %#v and %#v", msg.Short, msg.Full)
+	}
+}
+
+func TestTimePrecision(t *testing.T) {
+	now := time.Unix(1500000000, 123456789)
+	for precision, expected := range map[TimePrecision]int64{
+		PrecisionSeconds:      1500000000,
+		PrecisionMilliseconds: 1500000000123,
+		PrecisionMicroseconds: 1500000000123456,
+	} {
+		if ts := precision.timestamp(now); ts != expected {
+			t.Errorf("precision %d: expected %d, got %d", precision, expected, ts)
+		}
+	}
+}
+
+func TestEntryToMessage(t *testing.T) {
+	hook, _ := newTestHook(t, WithExtra(map[string]interface{}{"foo": "bar"}))
+	entry := logrus.WithField("withField", "1")
+	entry.Level = logrus.WarnLevel
+	entry.Message = "short\nfull"
+
+	caller := Caller{File: "/src/app/main.go", Line: 42, Function: "main.main"}
+	msg := hook.EntryToMessage(entry, caller)
+
+	if msg.File != caller.File || msg.Line != caller.Line {
+		t.Errorf("Caller: expected %s:%d, got %s:%d", caller.File, caller.Line, msg.File, msg.Line)
+	}
+	if msg.Short != "short" || msg.Full != "short\nfull" {
+		t.Errorf("Message: got short %q, full %q", msg.Short, msg.Full)
+	}
+	if msg.Facility != "test_facility" {
+		t.Errorf("Facility: expected %q, got %q", "test_facility", msg.Facility)
+	}
+	if msg.Extra["_foo"] != "bar" || msg.Extra["_withField"] != "1" {
+		t.Errorf("Extra: got %v", msg.Extra)
+	}
+}
+
+func TestDeduplicateHooks(t *testing.T) {
+	r, err := gelf.NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+
+	if _, err := NewGraylogHook(r.Addr(), "dedup", nil); err != nil {
+		t.Fatalf("NewGraylogHook: %s", err)
+	}
+	if _, err := NewGraylogHook(r.Addr(), "dedup", nil); err != nil {
+		t.Errorf("Duplicate hook refused with AllowDuplicateHooks: %s", err)
+	}
+	if _, err := NewGraylogHookWithOptions(r.Addr(), WithFacility("dedup"), WithDeduplicateHooks(WarnDuplicateHooks)); err != nil {
+		t.Errorf("Duplicate hook refused with WarnDuplicateHooks: %s", err)
+	}
+	if _, err := NewGraylogHookWithOptions(r.Addr(), WithFacility("dedup"), WithDeduplicateHooks(RefuseDuplicateHooks)); err != ErrDuplicateHook {
+		t.Errorf("Duplicate hook with RefuseDuplicateHooks: expected ErrDuplicateHook, got %v", err)
+	}
+	if _, err := NewGraylogHookWithOptions(r.Addr(), WithFacility("other"), WithDeduplicateHooks(RefuseDuplicateHooks)); err != nil {
+		t.Errorf("Hook with another facility refused: %s", err)
+	}
+}
+
+func TestEmitULID(t *testing.T) {
+	hook, r := newTestHook(t)
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if got, ok := msg.Extra["_ulid"]; ok {
+		t.Errorf("_ulid: expected none by default, got %v", got)
+	}
+
+	hook, r = newTestHook(t)
+	hook.EmitULID = true
+	hook.ULIDField = "order_key"
+	log = logrus.New()
+	log.Hooks.Add(hook)
+	// fired within the same millisecond, most likely
+	for i := 0; i < 3; i++ {
+		log.Info("test message")
+	}
+
+	prev := ""
+	for i := 0; i < 3; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		id, _ := msg.Extra["_order_key"].(string)
+		if len(id) != 26 {
+			t.Fatalf("_order_key: expected a ULID, got %#v", msg.Extra["_order_key"])
+		}
+		if id <= prev {
+			t.Errorf("_order_key: expected %s to sort after %s", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestEmitGoroutineID(t *testing.T) {
+	hook, r := newTestHook(t)
+	hook.EmitGoroutineID = true
+	log := logrus.New()
+	log.Hooks.Add(hook)
+
+	id := goroutineID()
+	if id == 0 {
+		t.Fatal("goroutineID: got 0")
+	}
+	log.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	// The IDs decode as float64 from JSON
+	if got := msg.Extra["_goroutine_id"]; got != float64(id) {
+		t.Errorf("_goroutine_id: expected %d, got %v", id, got)
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	hook, _ := newTestHook(t)
+
+	msg := hook.EntryToMessage(logrus.WithError(errors.New("connection refused")), Caller{})
+	if msg.Short != "connection refused" {
+		t.Errorf("Short with error: expected %q, got %q", "connection refused", msg.Short)
+	}
+	if msg.Extra["_error"] != "connection refused" {
+		t.Errorf("_error: expected %q, got %v", "connection refused", msg.Extra["_error"])
+	}
+
+	msg = hook.EntryToMessage(logrus.WithField("foo", "bar"), Caller{})
+	if msg.Short != "" {
+		t.Errorf("Short without placeholder: expected empty, got %q", msg.Short)
+	}
+
+	hook.EmptyMessagePlaceholder = "(no message)"
+	msg = hook.EntryToMessage(logrus.WithField("foo", "bar"), Caller{})
+	if msg.Short != "(no message)" {
+		t.Errorf("Short with placeholder: expected %q, got %q", "(no message)", msg.Short)
+	}
+	msg = hook.EntryToMessage(logrus.WithError(errors.New("connection refused")), Caller{})
+	if msg.Short != "connection refused" {
+		t.Errorf("Short with error and placeholder: expected %q, got %q", "connection refused", msg.Short)
+	}
+}
+
+func TestWorkerID(t *testing.T) {
+	hook, r := newTestHook(t)
+	var mu sync.Mutex
+	workers := map[uint64]string{}
+	hook.WorkerID = func() (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		id, ok := workers[goroutineID()]
+		return id, ok
+	}
+	log := logrus.New()
+	log.Hooks.Add(hook)
+
+	done := make(chan struct{})
+	go func() {
+		mu.Lock()
+		workers[goroutineID()] = "worker-1"
+		mu.Unlock()
+		log.Info("from worker")
+		close(done)
+	}()
+	<-done
+	log.Info("from main")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_worker"] != "worker-1" {
+		t.Errorf("_worker: expected %q, got %v", "worker-1", msg.Extra["_worker"])
+	}
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if _, ok := msg.Extra["_worker"]; ok {
+		t.Errorf("_worker: expected none, got %v", msg.Extra["_worker"])
+	}
+}
+
+func TestNewGraylogHookError(t *testing.T) {
+	hook, err := NewGraylogHook("no port", "test_facility", nil)
+	if err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+	if hook != nil {
+		t.Errorf("expected no hook, got %v", hook)
+	}
+}
+
+func TestClose(t *testing.T) {
+	hook, r := newTestHook(t)
+	hook.RollupRules = []RollupRule{{MessagePrefix: "cache miss", Interval: time.Hour}}
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+	log.Info("cache miss")
+	log.Info("cache miss")
+
+	if err := hook.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	if err := hook.Close(); err != nil {
+		t.Errorf("Close again: %s", err)
+	}
+	log.Info("dropped")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "test message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "test message", msg.Short)
+	}
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_rollup_count"] != float64(2) {
+		t.Errorf("expected the pending rollup with a count of 2, got %#v %v", msg.Short, msg.Extra)
+	}
+	if len(hook.buf) != 0 {
+		t.Errorf("expected the entries fired after Close to be dropped, got %d", len(hook.buf))
+	}
+
+	// The hook no longer counts as a duplicate
+	hook, err = NewGraylogHookWithOptions(r.Addr(), WithFacility("test_facility"), WithDeduplicateHooks(RefuseDuplicateHooks))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions after Close: %s", err)
+	}
+	hook.Close()
+}
+
+func TestCloseWhileBlocked(t *testing.T) {
+	// A full buffer and no background goroutine: Fire waits for a slot
+	hook := newHook(nil)
+	hook.buf = make(chan graylogEntry)
+	done := make(chan error)
+	go func() { done <- hook.Fire(logrus.NewEntry(logrus.New())) }()
+	time.Sleep(10 * time.Millisecond)
+
+	close(hook.quit)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Fire: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Fire to return once the hook is closed")
+	}
+}
+
+func TestStackTraceField(t *testing.T) {
+	hook, r := newTestHook(t)
+	hook.StackTraceField = "capture_stack"
+	log := logrus.New()
+	log.Hooks.Add(hook)
+
+	log.WithField("capture_stack", true).Error("with stack")
+	log.WithField("capture_stack", false).Error("without stack")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	stack, _ := msg.Extra["_stacktrace"].(string)
+	if !strings.HasPrefix(stack, "github.com/alfatraining/logrus-hooks/graylog.TestStackTraceField\n") {
+		t.Errorf("_stacktrace: expected to start with the caller, got %q", stack)
+	}
+	if strings.Contains(stack, "logrus.(*Entry)") {
+		t.Errorf("_stacktrace: expected no logrus frames, got %q", stack)
+	}
+	if _, ok := msg.Extra["_capture_stack"]; ok {
+		t.Error("_capture_stack: expected the trigger field to be removed")
+	}
+
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if _, ok := msg.Extra["_stacktrace"]; ok {
+		t.Errorf("_stacktrace: expected none, got %v", msg.Extra["_stacktrace"])
+	}
+	if _, ok := msg.Extra["_capture_stack"]; ok {
+		t.Error("_capture_stack: expected the trigger field to be removed")
+	}
+}
+
+func TestAddTags(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_tags"] != nil {
+		t.Errorf("_tags: expected none, got %#v", msg.Extra["_tags"])
+	}
+	hook.AddTags("canary", "beta")
+	hook.AddTags("beta", "eu")
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_tags"] != `["beta","canary","eu"]` {
+		t.Errorf("_tags: expected %#v, got %#v", `["beta","canary","eu"]`, msg.Extra["_tags"])
+	}
+	hook.RemoveTags("canary")
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_tags"] != `["beta","eu"]` {
+		t.Errorf("_tags: expected %#v, got %#v", `["beta","eu"]`, msg.Extra["_tags"])
+	}
+	hook.RemoveTags("beta", "eu")
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_tags"] != nil {
+		t.Errorf("_tags: expected none, got %#v", msg.Extra["_tags"])
+	}
+
+	arrays, _ := newTestHook(t, allowArrayFields)
+	arrays.AddTags("eu", "beta")
+	msg := arrays.EntryToMessage(entry, Caller{})
+	if tags, _ := msg.Extra["_tags"].([]interface{}); len(tags) != 2 || tags[0] != "beta" || tags[1] != "eu" {
+		t.Errorf("_tags: expected [beta eu], got %#v", msg.Extra["_tags"])
+	}
+}
+
+func TestPackageFacilities(t *testing.T) {
+	hook, _ := newTestHook(t, WithFacility("default_facility"))
+	hook.PackageFacilities = map[string]string{
+		"example.com/monorepo/billing":         "billing",
+		"example.com/monorepo/billing/invoice": "invoicing",
+		"example.com/monorepo/search":          "search",
+	}
+
+	for function, expected := range map[string]string{
+		"example.com/monorepo/billing.Charge":                "billing",
+		"example.com/monorepo/billing/payment.(*Client).Pay": "billing",
+		"example.com/monorepo/billing/invoice.Send":          "invoicing",
+		"example.com/monorepo/search/index.Build.func1":      "search",
+		"example.com/monorepo/searchengine.Query":            "default_facility",
+		"example.com/other.Main":                             "default_facility",
+		"":                                                   "default_facility",
+	} {
+		msg := hook.EntryToMessage(logrus.WithField("foo", "bar"), Caller{Function: function})
+		if msg.Facility != expected {
+			t.Errorf("%s: expected facility %#v, got %#v", function, expected, msg.Facility)
+		}
+	}
+}
+
+func TestLevelMap(t *testing.T) {
+	hook, _ := newTestHook(t)
+	other, _ := newTestHook(t)
+	hook.LevelMap = map[logrus.Level]int32{logrus.WarnLevel: 5}
+
+	for _, test := range []struct {
+		hook     *Hook
+		level    logrus.Level
+		expected int32
+	}{
+		{hook, logrus.WarnLevel, 5},
+		{hook, logrus.ErrorLevel, 3},
+		{other, logrus.WarnLevel, 4},
+		{other, logrus.TraceLevel, 7},
+	} {
+		entry := logrus.WithField("foo", "bar")
+		entry.Level = test.level
+		if msg := test.hook.EntryToMessage(entry, Caller{}); msg.Level != test.expected {
+			t.Errorf("%s: expected level %d, got %d", test.level, test.expected, msg.Level)
+		}
+	}
+}
+
+func TestEntryTime(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+	entry.Time = time.Unix(1500000000, 123456789)
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.TimeUnixMs != 1500000000123 {
+		t.Errorf("TimeUnixMs: expected the time of the entry %d, got %d", 1500000000123, msg.TimeUnixMs)
+	}
+
+	entry.Time = time.Time{}
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	msg := hook.EntryToMessage(entry, Caller{})
+	if msg.TimeUnixMs < before {
+		t.Errorf("TimeUnixMs: expected the current time for a zero time, got %d", msg.TimeUnixMs)
+	}
+}
+
+func TestNonBlocking(t *testing.T) {
+	hook := &Hook{buf: make(chan graylogEntry, 1)} // no fire() goroutine
+	if hook.Blocking {
+		t.Fatal("expected a zero Hook to be non-blocking")
+	}
+	if h, err := NewGraylogHook("127.0.0.1:0", "test_facility", nil); err != nil || !h.Blocking {
+		t.Errorf("expected NewGraylogHook to return a blocking hook, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		hook.Fire(logrus.WithField("n", 1))
+		hook.Fire(logrus.WithField("n", 2)) // dropped
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Fire blocked on a full buffer")
+	}
+	if len(hook.buf) != 1 || hook.Dropped() != 1 {
+		t.Errorf("expected 1 entry buffered and 1 dropped, got %d and %d", len(hook.buf), hook.Dropped())
+	}
+}
+
+func TestNonBlockingAlwaysDeliverLevels(t *testing.T) {
+	hook := &Hook{ // no fire() goroutine
+		buf:                 make(chan graylogEntry, 1),
+		quit:                make(chan struct{}),
+		AlwaysDeliverLevels: []logrus.Level{logrus.ErrorLevel},
+	}
+	entry := logrus.WithField("n", 1)
+	entry.Level = logrus.InfoLevel
+	hook.Fire(entry)
+
+	done := make(chan struct{})
+	go func() {
+		entry := logrus.WithField("n", 2)
+		entry.Level = logrus.ErrorLevel
+		hook.Fire(entry) // waits for a slot
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected Fire to wait for a slot for an entry of the AlwaysDeliverLevels")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if first := <-hook.buf; first.Data["n"] != 1 {
+		t.Errorf("expected the info entry first, got %v", first.Data)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Fire still blocked with a free slot")
+	}
+	if second := <-hook.buf; second.Data["n"] != 2 || hook.Dropped() != 0 {
+		t.Errorf("expected the error entry delivered and none dropped, got %v and %d", second.Data, hook.Dropped())
+	}
+}
+
+func TestEmitProcessStart(t *testing.T) {
+	hook, _ := newTestHook(t)
+	hook.EmitProcessStart = true
+
+	first := hook.EntryToMessage(logrus.WithField("foo", "bar"), Caller{})
+	start, ok := first.Extra["_process_start"].(string)
+	if !ok {
+		t.Fatalf("_process_start: expected a string, got %#v", first.Extra["_process_start"])
+	}
+	if ts, err := time.Parse(time.RFC3339, start); err != nil || ts.After(time.Now()) {
+		t.Errorf("_process_start: expected a past RFC 3339 time, got %#v (%v)", start, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	hook.ProcessStartField = "run"
+	second := hook.EntryToMessage(logrus.WithField("foo", "bar"), Caller{})
+	if second.Extra["_run"] != start {
+		t.Errorf("_run: expected the same start %#v, got %#v", start, second.Extra["_run"])
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	hook, _ := newTestHook(t)
+	hook.gelfLogger.Close() // make the writes fail
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+	log.Info("test message")
+
+	deadline := time.Now().Add(time.Second)
+	for hook.WriteErrors() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := hook.WriteErrors(); n != 2 {
+		t.Errorf("WriteErrors: expected 2, got %d", n)
+	}
+	if n := hook.Dropped(); n != 0 {
+		t.Errorf("Dropped: expected 0, got %d", n)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(time.Minute, 0); d != time.Minute {
+		t.Errorf("expected no jitter with 0, got %s", d)
+	}
+	spread := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Minute, 0.1)
+		if d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("expected between 54s and 66s, got %s", d)
+		}
+		spread[d] = true
+	}
+	if len(spread) < 2 {
+		t.Error("expected the durations to be spread")
+	}
+}
+
+func TestHostnameOnce(t *testing.T) {
+	hook, _ := newTestHook(t)
+	if hook.host != hostname() {
+		t.Errorf("expected the host name %#v to be looked up by NewGraylogHook, got %#v", hostname(), hook.host)
+	}
+	hook.host = "looked-up-once"
+	if msg := hook.EntryToMessage(logrus.WithField("foo", "bar"), Caller{}); msg.Host != "looked-up-once" {
+		t.Errorf("Host: expected %#v, got %#v", "looked-up-once", msg.Host)
+	}
+}
+
+func TestHost(t *testing.T) {
+	hook, r := newTestHook(t)
+	hook.Host = "node-1"
+	hook.CallerSideEnrichments = []Enrichment{EnrichHostname}
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Host != "node-1" {
+		t.Errorf("Host: expected %#v, got %#v", "node-1", msg.Host)
+	}
+}
+
+func TestNumericTypes(t *testing.T) {
+	hook, r := newTestHook(t)
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	fields := logrus.Fields{
+		"int8":    int8(-8),
+		"int16":   int16(16),
+		"int32":   int32(32),
+		"int64":   int64(64),
+		"uint":    uint(1),
+		"uint8":   uint8(8),
+		"uint16":  uint16(16),
+		"uint32":  uint32(32),
+		"uint64":  uint64(64),
+		"float32": float32(0.5),
+		"number":  json.Number("12.5"),
+	}
+	log.WithFields(fields).Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	expected := map[string]float64{
+		"int8": -8, "int16": 16, "int32": 32, "int64": 64,
+		"uint": 1, "uint8": 8, "uint16": 16, "uint32": 32, "uint64": 64,
+		"float32": 0.5, "number": 12.5,
+	}
+	for k, v := range expected {
+		// numbers decode as float64 from JSON, strings would not
+		if msg.Extra["_"+k] != v {
+			t.Errorf("_%s: expected the number %v, got %#v", k, v, msg.Extra["_"+k])
+		}
+	}
+}
+
+func TestErrorValues(t *testing.T) {
+	hook, _ := newTestHook(t)
+	inner := errors.New("connection refused")
+	entry := logrus.WithError(fmt.Errorf("wrap: %w", inner))
+	entry.Message = "test message"
+
+	msg := hook.EntryToMessage(entry, Caller{})
+	if msg.Extra["_error"] != "wrap: connection refused" {
+		t.Errorf("_error: expected %#v, got %#v", "wrap: connection refused", msg.Extra["_error"])
+	}
+}
+
+func TestFlush(t *testing.T) {
+	hook, _ := newTestHook(t, WithBufferSnapshots())
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	for i := 0; i < 100; i++ {
+		log.Info("test message")
+	}
+
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if n := len(hook.buf); n != 0 {
+		t.Errorf("expected an empty buffer after Flush, got %d entries", n)
+	}
+	if snapshot := hook.BufferSnapshot(); snapshot.Count != 0 {
+		t.Errorf("expected no pending entry after Flush, got %d", snapshot.Count)
+	}
+
+	// A cancelled context stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	blocked := &Hook{buf: make(chan graylogEntry)} // no fire() goroutine
+	if err := blocked.Flush(ctx); err != context.Canceled {
+		t.Errorf("Flush: expected %v, got %v", context.Canceled, err)
+	}
+
+	hook.Close()
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Errorf("Flush after Close: %s", err)
+	}
+}
+
+func TestCallerFunction(t *testing.T) {
+	hook, r := newTestHook(t)
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	function, _ := msg.Extra["_func"].(string)
+	if !strings.HasSuffix(function, ".TestCallerFunction") {
+		t.Errorf("_func: expected the test function, got %#v", msg.Extra["_func"])
+	}
+}
+
+func TestDisableCaller(t *testing.T) {
+	hook, r := newTestHook(t, WithDisableCaller())
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.File != "" || msg.Line != 0 {
+		t.Errorf("expected no caller, got %s:%d", msg.File, msg.Line)
+	}
+	if _, ok := msg.Extra["_func"]; ok {
+		t.Errorf("_func: expected none, got %#v", msg.Extra["_func"])
+	}
+}
+
+func benchmarkFire(b *testing.B, disableCaller bool) {
+	hook := &Hook{Blocking: true, DisableCaller: disableCaller, buf: make(chan graylogEntry, 1024)}
+	go func() {
+		for range hook.buf {
+		}
+	}()
+	defer close(hook.buf)
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	entry := log.WithField("foo", "bar")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry.Info("test message")
+	}
+}
+
+func BenchmarkFireWithCaller(b *testing.B)    { benchmarkFire(b, false) }
+func BenchmarkFireDisableCaller(b *testing.B) { benchmarkFire(b, true) }
+
+type panickingStringer struct{}
+
+func (panickingStringer) String() string { panic("bad String") }
+
+type panickingError struct{}
+
+func (panickingError) Error() string { panic("bad Error") }
+
+func TestRecoverFromPanics(t *testing.T) {
+	hook, r := newTestHook(t)
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.WithField("stringer", panickingStringer{}).Info("bad stringer")
+	log.WithField("error", panickingError{}).Info("bad error")
+	log.Info("test message")
+
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short == "bad error" {
+			t.Errorf("expected the entry with a panicking error to be dropped")
+		}
+		if msg.Short == "test message" {
+			break
+		}
+	}
+}
+
+func TestMaxShortLen(t *testing.T) {
+	hook, _ := newTestHook(t)
+	hook.MaxShortLen = 5
+	entry := logrus.WithField("foo", "bar")
+
+	entry.Message = "żółć gęślą jaźń"
+	msg := hook.EntryToMessage(entry, Caller{})
+	if msg.Short != "żółć …" {
+		t.Errorf("Short: expected %#v, got %#v", "żółć …", msg.Short)
+	}
+	if msg.Full != entry.Message {
+		t.Errorf("Full: expected the whole message %#v, got %#v", entry.Message, msg.Full)
+	}
+
+	entry.Message = "żółć\nsecond line"
+	msg = hook.EntryToMessage(entry, Caller{})
+	if msg.Short != "żółć" || msg.Full != entry.Message {
+		t.Errorf("expected a short first line unchanged, got %#v and %#v", msg.Short, msg.Full)
+	}
+}
+
+func TestStackTraceLevels(t *testing.T) {
+	hook, r := newTestHook(t)
+	hook.StackTraceLevels = []logrus.Level{logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel}
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Error("error message")
+	log.Info("info message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	stack, _ := msg.Extra["_stacktrace"].(string)
+	if !strings.HasPrefix(stack, "github.com/alfatraining/logrus-hooks/graylog.TestStackTraceLevels\n") {
+		t.Errorf("_stacktrace: expected to start with the caller at error level, got %q", stack)
+	}
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if _, ok := msg.Extra["_stacktrace"]; ok {
+		t.Errorf("_stacktrace: expected none at info level, got %v", msg.Extra["_stacktrace"])
+	}
+}
+
+func TestRetries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	tcp := newTCPReader(t, l)
+	defer tcp.Close()
+	hook, err := NewGraylogHookWithOptions(l.Addr().String(), WithTCP(), WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	hook.OnConnectMessage = &gelf.Message{Version: "1.1", Host: "test", Short: "connected"}
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("first message")
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	hook.gelfLogger.Close() // break the connection, redial recovers
+	log.Info("test message")
+
+	for _, expected := range []string{"connected", "first message", "connected", "test message"} {
+		if msg := tcp.ReadMessage(t); msg.Short != expected {
+			t.Errorf("msg.Short: expected %#v, got %#v", expected, msg.Short)
+		}
+	}
+	if n := hook.WriteErrors(); n != 0 {
+		t.Errorf("WriteErrors: expected 0, got %d", n)
+	}
+
+	// UDP has no connection to send the OnConnectMessage through
+	udp, r := newTestHook(t)
+	udp.OnConnectMessage = hook.OnConnectMessage
+	udp.Fire(logrus.WithField("foo", "bar"))
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short == "connected" {
+		t.Error("expected no OnConnectMessage over UDP")
+	}
+
+	// Without an address to dial, the retries are exhausted
+	w, err := gelf.NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w.Close()
+	hook = NewGraylogHookFromWriter(w, "test_facility", nil, WithRetries(2, time.Millisecond))
+	hook.Fire(logrus.WithField("foo", "bar"))
+	hook.Flush(context.Background())
+	if n := hook.WriteErrors(); n != 1 {
+		t.Errorf("WriteErrors: expected 1 after the retries, got %d", n)
+	}
+}
+
+type tenantKey struct{}
+
+func TestContextFields(t *testing.T) {
+	hook, _ := newTestHook(t)
+	hook.ContextFields = map[string]interface{}{"tenant": tenantKey{}, "trace_id": "trace"}
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	entry := logrus.WithContext(ctx).WithField("foo", "bar")
+	msg := hook.EntryToMessage(entry, Caller{})
+	if msg.Extra["_tenant"] != "acme" {
+		t.Errorf("_tenant: expected %#v, got %#v", "acme", msg.Extra["_tenant"])
+	}
+	if v, ok := msg.Extra["_trace_id"]; ok {
+		t.Errorf("_trace_id: expected none without a value, got %#v", v)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	hook, _ := newTestHook(t)
+	errs := make(chan error, 1)
+	hook.OnError = func(err error) { errs <- err }
+	hook.gelfLogger.Close() // make the writes fail
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("OnError: expected an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnError: not called for a write error")
+	}
+
+	full := &Hook{buf: make(chan graylogEntry), OnError: hook.OnError} // no fire() goroutine
+	full.Fire(logrus.WithField("foo", "bar"))
+	if err := <-errs; err != ErrBufferFull {
+		t.Errorf("OnError: expected ErrBufferFull for a dropped entry, got %v", err)
+	}
+}
+
+func TestSynchronous(t *testing.T) {
+	hook, r := newTestHook(t)
+	hook.Synchronous = true
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	caller := CurrentCaller()
+	log.Info("test message")
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "test message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "test message", msg.Short)
+	}
+	if msg.File != caller.File || msg.Line != caller.Line+1 {
+		t.Errorf("caller: expected %s:%d, got %s:%d", caller.File, caller.Line+1, msg.File, msg.Line)
+	}
+
+	// The write error is returned, and counted by the time Fire returns
+	hook.gelfLogger.Close()
+	entry := logrus.WithField("foo", "bar")
+	entry.Message = "test message"
+	if err := hook.Fire(entry); err == nil {
+		t.Error("Fire: expected the write error")
+	}
+	if n := hook.WriteErrors(); n != 1 {
+		t.Errorf("WriteErrors: expected 1, got %d", n)
+	}
+}
+
+func TestMaxSynchronousSends(t *testing.T) {
+	hook, r := newTestHook(t, WithSynchronous(1))
+
+	// The first entry waits for the writer, held here
+	hook.sendMu.Lock()
+	first := make(chan error)
+	go func() {
+		entry := logrus.NewEntry(logrus.New())
+		entry.Message = "first message"
+		first <- hook.Fire(entry)
+	}()
+	for len(hook.synchronousSlots()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The second one is buffered instead of waiting too
+	second := make(chan error)
+	go func() {
+		entry := logrus.NewEntry(logrus.New())
+		entry.Message = "second message"
+		second <- hook.Fire(entry)
+	}()
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Errorf("Fire: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the second entry to be buffered")
+	}
+	hook.sendMu.Unlock()
+	if err := <-first; err != nil {
+		t.Errorf("Fire: %s", err)
+	}
+
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		received[msg.Short] = true
+	}
+	if !received["first message"] || !received["second message"] {
+		t.Errorf("expected both messages, got %v", received)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	hook, r := newTestHook(t, WithBatching(10, 50*time.Millisecond))
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	// A burst fills several batches, the last one partially
+	const burst = 25
+	start := time.Now()
+	for i := 0; i < burst; i++ {
+		log.Infof("message %d", i)
+	}
+	for i := 0; i < burst; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if expected := fmt.Sprintf("message %d", i); msg.Short != expected {
+			t.Errorf("msg.Short: expected %#v, got %#v", expected, msg.Short)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the burst within the batch interval, took %s", elapsed)
+	}
+
+	// Flush doesn't wait for the batch interval
+	log.Info("last message")
+	ctx, cancel := context.WithTimeout(context.Background(), 40*time.Millisecond)
+	defer cancel()
+	if err := hook.Flush(ctx); err != nil {
+		t.Errorf("Flush: %s", err)
+	}
+}
+
+func TestSetExtra(t *testing.T) {
+	extra := map[string]interface{}{"foo": "bar"}
+	hook, r := newTestHook(t, WithExtra(extra))
+	log := logrus.New()
+	log.Hooks.Add(hook)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			log.Info("concurrent message")
+		}
+		close(done)
+	}()
+	hook.SetExtra("release", "2.0")
+	hook.RemoveExtra("foo")
+	<-done
+	if extra["release"] != nil || extra["foo"] != "bar" {
+		t.Errorf("expected the map passed to NewGraylogHook unchanged, got %v", extra)
+	}
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	log.Info("test message")
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != "test message" {
+			continue
+		}
+		if msg.Extra["_release"] != "2.0" {
+			t.Errorf("_release: expected %#v, got %#v", "2.0", msg.Extra["_release"])
+		}
+		if v, ok := msg.Extra["_foo"]; ok {
+			t.Errorf("_foo: expected none, got %#v", v)
+		}
+		break
+	}
+}
+
+func TestEmitImage(t *testing.T) {
+	t.Setenv("IMAGE_TAG", "v1.2.3")
+	t.Setenv("IMAGE_DIGEST", "sha256:abc")
+	t.Setenv("APP_TAG", "v2.0.0")
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+
+	msg := hook.EntryToMessage(entry, Caller{})
+	for _, field := range []string{"_image_tag", "_image_digest"} {
+		if _, ok := msg.Extra[field]; ok {
+			t.Errorf("%s: expected none by default, got %#v", field, msg.Extra[field])
+		}
+	}
+
+	hook.EmitImage = true
+	msg = hook.EntryToMessage(entry, Caller{})
+	if msg.Extra["_image_tag"] != "v1.2.3" || msg.Extra["_image_digest"] != "sha256:abc" {
+		t.Errorf("expected the image fields, got %v", msg.Extra)
+	}
+
+	hook, _ = newTestHook(t, WithImage("APP_TAG", "APP_DIGEST"))
+	msg = hook.EntryToMessage(entry, Caller{})
+	if msg.Extra["_image_tag"] != "v2.0.0" {
+		t.Errorf("_image_tag: expected %#v, got %#v", "v2.0.0", msg.Extra["_image_tag"])
+	}
+	if _, ok := msg.Extra["_image_digest"]; ok {
+		t.Errorf("_image_digest: expected none for a missing variable, got %#v", msg.Extra["_image_digest"])
+	}
+}
+
+func TestMetadataField(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+	entry.Level = logrus.WarnLevel
+
+	plain := hook.EntryToMessage(entry, Caller{})
+	hook.MetadataField = "meta"
+	msg := hook.EntryToMessage(entry, Caller{})
+	if len(msg.Extra) != len(plain.Extra)+1 {
+		t.Errorf("expected only the _meta field to be added, got %v", msg.Extra)
+	}
+
+	s, ok := msg.Extra["_meta"].(string)
+	if !ok {
+		t.Fatalf("_meta: expected a JSON string, got %#v", msg.Extra["_meta"])
+	}
+	var meta map[string]string
+	if err := json.Unmarshal([]byte(s), &meta); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	expected := map[string]string{"facility": "test_facility", "host": msg.Host, "severity": "warning"}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Errorf("_meta: expected %v, got %v", expected, meta)
+	}
+}
+
+func TestEmitUptime(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+	entry.Time = time.Now()
+
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_uptime_seconds"] != nil {
+		t.Errorf("_uptime_seconds: expected none by default, got %#v", msg.Extra["_uptime_seconds"])
+	}
+
+	hook.EmitUptime = true
+	msg := hook.EntryToMessage(entry, Caller{})
+	if uptime, ok := msg.Extra["_uptime_seconds"].(int64); !ok || uptime < 0 {
+		t.Errorf("_uptime_seconds: expected a positive number, got %#v", msg.Extra["_uptime_seconds"])
+	}
+
+	hook.started = entry.Time.Add(-time.Hour)
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_uptime_seconds"] != int64(3600) {
+		t.Errorf("_uptime_seconds: expected 3600, got %#v", msg.Extra["_uptime_seconds"])
+	}
+}
+
+func TestEmitSyslogLevel(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+	entry.Level = logrus.WarnLevel
+
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_syslog_level"] != nil {
+		t.Errorf("_syslog_level: expected none by default, got %#v", msg.Extra["_syslog_level"])
+	}
+
+	hook.EmitSyslogLevel = true
+	for level, expected := range map[logrus.Level]int32{logrus.WarnLevel: 4, logrus.DebugLevel: 7} {
+		entry.Level = level
+		if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_syslog_level"] != expected {
+			t.Errorf("_syslog_level of %s: expected %d, got %#v", level, expected, msg.Extra["_syslog_level"])
+		}
+	}
+
+	hook.SyslogLevelField = "level_number"
+	entry.Level = logrus.DebugLevel
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_level_number"] != int32(7) {
+		t.Errorf("_level_number: expected 7, got %#v", msg.Extra["_level_number"])
+	}
+}
+
+func TestEmitPlatform(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_goos"] != nil || msg.Extra["_goarch"] != nil {
+		t.Errorf("expected no platform fields by default, got %v", msg.Extra)
+	}
+
+	hook.EmitPlatform = true
+	msg := hook.EntryToMessage(entry, Caller{})
+	if msg.Extra["_goos"] != runtime.GOOS || msg.Extra["_goarch"] != runtime.GOARCH {
+		t.Errorf("expected _goos %s and _goarch %s, got %v", runtime.GOOS, runtime.GOARCH, msg.Extra)
+	}
+}
+
+func TestCallerSideEnrichments(t *testing.T) {
+	hook, r := newTestHook(t)
+	hook.EmitUptime = true
+	hook.CallerSideEnrichments = []Enrichment{EnrichUptime}
+	hook.started = time.Now().Add(-900 * time.Millisecond)
+
+	// The entry has no time, and the background goroutine is held long
+	// enough for a late uptime to reach the next second
+	hook.sendMu.Lock()
+	if err := hook.Fire(logrus.NewEntry(logrus.New())); err != nil {
+		t.Fatalf("Fire: %s", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	hook.sendMu.Unlock()
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_uptime_seconds"] != float64(0) {
+		t.Errorf("_uptime_seconds: expected 0 when fired, got %#v", msg.Extra["_uptime_seconds"])
+	}
+}
+
+func TestEmitRFC3339Timestamp(t *testing.T) {
+	hook, _ := newTestHook(t)
+	entry := logrus.WithField("foo", "bar")
+	entry.Time = time.Date(2024, 1, 2, 3, 4, 5, 678*int(time.Millisecond), time.UTC)
+
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_timestamp_rfc3339"] != nil {
+		t.Errorf("_timestamp_rfc3339: expected none by default, got %#v", msg.Extra["_timestamp_rfc3339"])
+	}
+
+	hook.EmitRFC3339Timestamp = true
+	msg := hook.EntryToMessage(entry, Caller{})
+	s, _ := msg.Extra["_timestamp_rfc3339"].(string)
+	ts, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		t.Fatalf("time.Parse: %s", err)
+	}
+	if !ts.Equal(entry.Time) {
+		t.Errorf("_timestamp_rfc3339: expected %s, got %s", entry.Time, ts)
+	}
+	if ts.UnixNano()/int64(time.Millisecond) != msg.TimeUnixMs {
+		t.Errorf("expected the same time as the GELF timestamp %d, got %s", msg.TimeUnixMs, ts)
+	}
+
+	hook.RFC3339TimestampField = "time"
+	if msg := hook.EntryToMessage(entry, Caller{}); msg.Extra["_time"] != s {
+		t.Errorf("_time: expected %#v, got %#v", s, msg.Extra["_time"])
+	}
+}
+
+func TestSuppressSelfLogs(t *testing.T) {
+	hook, r := newTestHook(t)
+	hook.SuppressSelfLogs = true
+
+	// The package warns about duplicate hooks through the standard logger
+	std := logrus.StandardLogger()
+	hooks, out := std.Hooks, std.Out
+	defer func() { std.Hooks, std.Out = hooks, out }()
+	std.Hooks = make(logrus.LevelHooks)
+	std.Out = io.Discard
+	std.Hooks.Add(hook)
+
+	duplicate, err := NewGraylogHookWithOptions(r.Addr(), WithFacility("test_facility"), WithDeduplicateHooks(WarnDuplicateHooks))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	duplicate.Close()
+	logrus.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "test message" {
+		t.Errorf("expected the warning of the package to be dropped, got %#v", msg.Short)
+	}
+}
@@ -0,0 +1,93 @@
+package graylog
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HeartbeatMessage is the message of the heartbeats, see StartHeartbeat
+const HeartbeatMessage = "heartbeat"
+
+// PingMessage is the message sent by Ping
+const PingMessage = "ping"
+
+// StartHeartbeat sends a heartbeat message, with the facility of the hook and
+// a heartbeat field set to true, every interval even when nothing is logged.
+// A missing heartbeat in Graylog then tells that the process or the logging
+// pipeline is stuck. The interval is spread by Jitter. The heartbeats go
+// through the buffer like the entries, and are skipped while it is full.
+// Calling it again replaces the previous interval.
+func (hook *Hook) StartHeartbeat(interval time.Duration) {
+	stop := make(chan struct{})
+	hook.mu.Lock()
+	if hook.heartbeat != nil {
+		close(hook.heartbeat)
+	}
+	hook.heartbeat = stop
+	hook.mu.Unlock()
+
+	fraction := hook.Jitter
+	go func() {
+		timer := time.NewTimer(jitter(interval, fraction))
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				hook.sendHeartbeat()
+				timer.Reset(jitter(interval, fraction))
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopHeartbeat stops the heartbeat started by StartHeartbeat
+func (hook *Hook) StopHeartbeat() {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if hook.heartbeat != nil {
+		close(hook.heartbeat)
+		hook.heartbeat = nil
+	}
+}
+
+// sendHeartbeat queues a heartbeat message, unless the buffer is full
+func (hook *Hook) sendHeartbeat() {
+	entry := graylogEntry{Entry: &logrus.Entry{
+		Data:    logrus.Fields{"heartbeat": true},
+		Time:    time.Now(),
+		Level:   logrus.InfoLevel,
+		Message: HeartbeatMessage,
+	}}
+	select {
+	case <-hook.quit:
+		return // closed
+	default:
+	}
+	hook.trackEnqueued(&entry)
+	select {
+	case hook.buf <- entry:
+	default:
+		hook.trackDequeued(entry)
+	}
+}
+
+// Ping writes a ping message right away, bypassing the buffer, with the
+// facility of the hook and a ping field set to true, at debug level, and
+// returns the write error, without retrying. It is meant as a readiness
+// check. Over TCP (see WithTCP and WithTLS), it fails when the connection is
+// broken. Over UDP, writing rarely fails: Ping only tells that the message
+// was written locally, not that Graylog received it.
+func (hook *Hook) Ping() error {
+	entry := graylogEntry{Entry: &logrus.Entry{
+		Data:    logrus.Fields{"ping": true},
+		Time:    time.Now(),
+		Level:   logrus.DebugLevel,
+		Message: PingMessage,
+	}}
+	hook.sendMu.Lock()
+	defer hook.sendMu.Unlock()
+	return hook.writeMessage(hook.message(entry, hook.config()))
+}
@@ -0,0 +1,75 @@
+package graylog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHeartbeat(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.StartHeartbeat(10 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != HeartbeatMessage {
+			t.Errorf("msg.Short: expected %#v, got %#v", HeartbeatMessage, msg.Short)
+		}
+		if msg.Facility != "test_facility" {
+			t.Errorf("msg.Facility: expected %#v, got %#v", "test_facility", msg.Facility)
+		}
+		if msg.Extra["_heartbeat"] != true {
+			t.Errorf("_heartbeat: expected true, got %v", msg.Extra["_heartbeat"])
+		}
+	}
+
+	hook.StopHeartbeat()
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("stopped")
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short == "stopped" {
+			break
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	log.Info("test message")
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "test message" {
+		t.Errorf("msg.Short: expected %#v after StopHeartbeat, got %#v", "test message", msg.Short)
+	}
+}
+
+func TestPing(t *testing.T) {
+	hook, r := newTestHook(t)
+	if err := hook.Ping(); err != nil {
+		t.Fatalf("Ping: %s", err)
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != PingMessage || msg.Extra["_ping"] != true {
+		t.Errorf("expected a ping message, got %#v with %v", msg.Short, msg.Extra)
+	}
+	if msg.Level != levelMap[logrus.DebugLevel] {
+		t.Errorf("msg.Level: expected %d, got %d", levelMap[logrus.DebugLevel], msg.Level)
+	}
+
+	hook.Close()
+	if err := hook.Ping(); err == nil {
+		t.Error("Ping: expected an error once the hook is closed")
+	}
+}
@@ -0,0 +1,354 @@
+package graylog
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/alfatraining/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
+)
+
+// Option is a setting of a hook, applied by NewGraylogHookWithOptions before
+// the hook starts sending in the background.
+type Option func(*Hook)
+
+// WithFacility sets the facility of the messages, see Hook.Facility
+func WithFacility(facility string) Option {
+	return func(hook *Hook) {
+		hook.Facility = facility
+	}
+}
+
+// WithExtra sets fields added to all the messages, see Hook.Extra
+func WithExtra(extra map[string]interface{}) Option {
+	return func(hook *Hook) {
+		hook.Extra = extra
+	}
+}
+
+// WithHost sets the host of the messages, see Hook.Host
+func WithHost(host string) Option {
+	return func(hook *Hook) {
+		hook.Host = host
+	}
+}
+
+// WithBlocking sets whether Fire waits while the buffer is full, see
+// Hook.Blocking
+func WithBlocking(blocking bool) Option {
+	return func(hook *Hook) {
+		hook.Blocking = blocking
+	}
+}
+
+// WithLevelMap overrides the syslog levels of logrus levels, see
+// Hook.LevelMap
+func WithLevelMap(levels map[logrus.Level]int32) Option {
+	return func(hook *Hook) {
+		hook.LevelMap = levels
+	}
+}
+
+// WithLevels sets the levels of the entries sent to Graylog, see
+// Hook.EnabledLevels
+func WithLevels(levels ...logrus.Level) Option {
+	return func(hook *Hook) {
+		hook.EnabledLevels = levels
+	}
+}
+
+// WithDisableCaller skips the lookup of the caller, see Hook.DisableCaller
+func WithDisableCaller() Option {
+	return func(hook *Hook) {
+		hook.DisableCaller = true
+	}
+}
+
+// WithRetries retries the writing of the messages which failed, see
+// Hook.MaxRetries
+func WithRetries(max int, delay time.Duration) Option {
+	return func(hook *Hook) {
+		hook.MaxRetries = max
+		hook.RetryDelay = delay
+	}
+}
+
+// WithBatching makes the hook send the entries in batches of up to size
+// entries, waiting up to interval for them, see Hook.BatchSize
+func WithBatching(size int, interval time.Duration) Option {
+	return func(hook *Hook) {
+		hook.BatchSize = size
+		hook.BatchInterval = interval
+	}
+}
+
+// WithRedactKeys replaces the values of the fields named keys with
+// RedactedValue, see Hook.RedactKeys
+func WithRedactKeys(keys ...string) Option {
+	return func(hook *Hook) {
+		hook.RedactKeys = keys
+	}
+}
+
+// WithRateLimit limits the entries sent to limit per second, with bursts of
+// up to burst entries, see Hook.RateLimit
+func WithRateLimit(limit float64, burst int) Option {
+	return func(hook *Hook) {
+		hook.RateLimit = limit
+		hook.Burst = burst
+	}
+}
+
+// WithSynchronous writes the entries inline in Fire, with at most maxSends
+// goroutines waiting at once, see Hook.Synchronous and
+// Hook.MaxSynchronousSends
+func WithSynchronous(maxSends int) Option {
+	return func(hook *Hook) {
+		hook.Synchronous = true
+		hook.MaxSynchronousSends = maxSends
+	}
+}
+
+// WithImage adds the fields describing the image, read from the tagEnv and
+// digestEnv environment variables ("IMAGE_TAG" and "IMAGE_DIGEST" when
+// empty), see Hook.EmitImage
+func WithImage(tagEnv, digestEnv string) Option {
+	return func(hook *Hook) {
+		hook.EmitImage = true
+		hook.ImageTagEnv = tagEnv
+		hook.ImageDigestEnv = digestEnv
+	}
+}
+
+// WithPrioritizeHighSeverity queues the entries at the Error level and above
+// in a separate buffer, see Hook.PrioritizeHighSeverity
+func WithPrioritizeHighSeverity() Option {
+	return func(hook *Hook) {
+		hook.PrioritizeHighSeverity = true
+	}
+}
+
+// WithDeduplicateHooks sets what happens when a hook with the same address
+// and facility was already created, AllowDuplicateHooks by default: two such
+// hooks added to a logger double the messages sent to Graylog.
+func WithDeduplicateHooks(policy DuplicateHookPolicy) Option {
+	return func(hook *Hook) {
+		hook.duplicates = policy
+	}
+}
+
+// WithBufferSnapshots keeps track of the buffered entries for
+// Hook.BufferSnapshot, see Hook.TrackBuffer
+func WithBufferSnapshots() Option {
+	return func(hook *Hook) {
+		hook.TrackBuffer = true
+	}
+}
+
+// WithBufSize sets the number of entries the buffer of the hook holds,
+// instead of the package BufSize
+func WithBufSize(size uint) Option {
+	return func(hook *Hook) {
+		hook.bufSize = size
+	}
+}
+
+// WithCompression sets the compression of the messages, gelf.CompressGzip,
+// gelf.CompressZlib or gelf.CompressNone, and its level, one of the constants
+// of compress/flate. No compression saves CPU, the best compression saves
+// bandwidth. It doesn't apply to TCP, which doesn't support compression.
+func WithCompression(compression gelf.CompressType, level int) Option {
+	return func(hook *Hook) {
+		hook.writerOptions = append(hook.writerOptions, func(w *gelf.Writer) {
+			w.CompressionType = compression
+			w.CompressionLevel = level
+		})
+	}
+}
+
+// WithTCP sends the messages over TCP instead of UDP, see WithTLS
+func WithTCP() Option {
+	return func(hook *Hook) {
+		hook.network = "tcp"
+	}
+}
+
+// WithUnix sends the messages to a Unix socket, like the one of a local log
+// shipper, the address being the path of the socket, see NewGraylogHookUnix
+func WithUnix() Option {
+	return func(hook *Hook) {
+		hook.network = "unix"
+	}
+}
+
+// WithTLS sends the messages over TCP with TLS, configured by config: the
+// certificate authorities, the client certificates, the server name... The
+// TLS handshake is done when the connection is established: when it fails,
+// NewGraylogHookWithOptions returns the error, and dialing again after a
+// write error (see Hook.MaxRetries) keeps the broken connection.
+func WithTLS(config *tls.Config) Option {
+	return func(hook *Hook) {
+		hook.tlsConfig = config
+	}
+}
+
+// WithEncoder encodes the messages sent over TCP, TLS or a Unix socket with
+// encode instead of EncodeJSON, for example with EncodeMsgpack for the
+// collectors accepting msgpack GELF. It doesn't apply to UDP, where go-gelf
+// encodes the messages as JSON, nor to the writers of WithDialer, which
+// encode them themselves.
+func WithEncoder(encode Encoder) Option {
+	return func(hook *Hook) {
+		hook.encoder = encode
+	}
+}
+
+// WithDialer sends over the writers returned by dial for the addresses of the
+// hook, to use a transport the package doesn't provide, like QUIC. They are
+// dialed again like the TCP connections when writing fails, see
+// Hook.MaxRetries.
+func WithDialer(dial func(addr string) (MessageWriter, error)) Option {
+	return func(hook *Hook) {
+		hook.dialer = dial
+	}
+}
+
+// NewGraylogHookWithOptions creates a hook sending to addr, with the settings
+// of opts. Unlike the fields set once the hook is created, the options are
+// applied before the hook starts sending in the background. It returns an
+// error when the Gelf writer can't be created, for example when addr can't be
+// resolved.
+func NewGraylogHookWithOptions(addr string, opts ...Option) (*Hook, error) {
+	return NewGraylogHookWithFailover([]string{addr}, opts...)
+}
+
+// NewGraylogHookWithFailover creates a hook sending to the first of addrs
+// which can be dialed, like NewGraylogHookWithOptions. When writing to it
+// still fails after the retries (see Hook.MaxRetries), the hook fails over
+// to the next address which can be dialed, wrapping around, see
+// Hook.ActiveAddr. Failures are mostly detected with TCP (see WithTCP), as
+// writing over UDP rarely fails.
+//
+// An address can name its own transport with a scheme, "udp://", "tcp://",
+// "tls://" or "unix://", instead of the transport options, to chain
+// different transports in order of preference, like a local sidecar over a
+// Unix socket then a remote collector over TCP. With Hook.FailbackInterval
+// the hook goes back to the preferred addresses once they can be dialed
+// again.
+func NewGraylogHookWithFailover(addrs []string, opts ...Option) (*Hook, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoAddress
+	}
+	hook := newHook(opts)
+	var w MessageWriter
+	var err error
+	for i, addr := range addrs {
+		if w, err = hook.dial(addr); err == nil {
+			hook.active = i
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	joined := strings.Join(addrs, ",")
+	if !registerHook(joined, hook.Facility, hook.duplicates) {
+		w.Close()
+		return nil, ErrDuplicateHook
+	}
+	hook.key = hookKey(joined, hook.Facility)
+	hook.addrs = addrs
+	hook.start(w)
+	return hook, nil
+}
+
+// dial returns a new writer for addr, with the dialer of WithDialer, or
+// according to the scheme of addr if any, or to the transport options
+func (hook *Hook) dial(addr string) (MessageWriter, error) {
+	if hook.dialer != nil {
+		return hook.dialer(addr)
+	}
+	if parts := strings.SplitN(addr, "://", 2); len(parts) == 2 {
+		switch parts[0] {
+		case "udp":
+			return hook.dialUDP(parts[1])
+		case "tcp", "unix":
+			return dialStream(parts[0], parts[1], nil, hook.encoder)
+		case "tls":
+			config := hook.tlsConfig
+			if config == nil {
+				config = &tls.Config{}
+			}
+			return dialStream("tcp", parts[1], config, hook.encoder)
+		}
+	}
+	if hook.tlsConfig != nil {
+		return dialStream("tcp", addr, hook.tlsConfig, hook.encoder)
+	}
+	if hook.network != "" {
+		return dialStream(hook.network, addr, nil, hook.encoder)
+	}
+	return hook.dialUDP(addr)
+}
+
+// dialUDP returns a new Gelf writer for addr, with the writer options
+func (hook *Hook) dialUDP(addr string) (MessageWriter, error) {
+	g, err := gelf.NewWriter(addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range hook.writerOptions {
+		opt(g)
+	}
+	return g, nil
+}
+
+// NewGraylogHookUnix creates a hook sending to the Unix socket at path, like
+// NewGraylogHook. It returns an error when the socket can't be dialed.
+func NewGraylogHookUnix(path string, facility string, extra map[string]interface{}) (*Hook, error) {
+	return NewGraylogHookWithOptions(path, WithFacility(facility), WithExtra(extra), WithUnix())
+}
+
+// NewGraylogHookFromWriter creates a hook sending with a Gelf writer already
+// created, for example configured differently, or sending to a test server.
+// Close closes the writer. WithDeduplicateHooks doesn't apply to these hooks.
+func NewGraylogHookFromWriter(w *gelf.Writer, facility string, extra map[string]interface{}, opts ...Option) *Hook {
+	hook := newHook(append([]Option{WithFacility(facility), WithExtra(extra)}, opts...))
+	for _, opt := range hook.writerOptions {
+		opt(w)
+	}
+	hook.start(w)
+	return hook
+}
+
+// newHook returns a hook with the default settings and opts, not started
+func newHook(opts []Option) *Hook {
+	hook := &Hook{
+		Blocking:        true,
+		IncludeSeverity: true,
+		FlattenDepth:    DefaultFlattenDepth,
+		started:         time.Now(),
+		host:            hostname(),
+		quit:            make(chan struct{}),
+		finished:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(hook)
+	}
+	hook.image = readImageFields(hook.ImageTagEnv, hook.ImageDigestEnv)
+	return hook
+}
+
+// start makes the hook send with w in the background
+func (hook *Hook) start(w MessageWriter) {
+	hook.gelfLogger = w
+	if hook.bufSize == 0 {
+		hook.bufSize = BufSize
+	}
+	hook.buf = make(chan graylogEntry, hook.bufSize)
+	if hook.PrioritizeHighSeverity {
+		hook.highBuf = make(chan graylogEntry, hook.bufSize)
+	}
+	go hook.fire() // Log in background
+}
@@ -0,0 +1,227 @@
+package graylog
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/alfatraining/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
+)
+
+func TestNewGraylogHookWithOptions(t *testing.T) {
+	r, err := gelf.NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	hook, err := NewGraylogHookWithOptions(r.Addr(),
+		WithFacility("options_facility"),
+		WithExtra(map[string]interface{}{"foo": "bar"}),
+		WithHost("node-1"),
+		WithBlocking(false),
+		WithLevelMap(map[logrus.Level]int32{logrus.WarnLevel: 5}),
+	)
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	if hook.Blocking {
+		t.Error("Blocking: expected false")
+	}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Warn("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Facility != "options_facility" {
+		t.Errorf("Facility: expected %#v, got %#v", "options_facility", msg.Facility)
+	}
+	if msg.Extra["_foo"] != "bar" {
+		t.Errorf("_foo: expected %#v, got %#v", "bar", msg.Extra["_foo"])
+	}
+	if msg.Host != "node-1" {
+		t.Errorf("Host: expected %#v, got %#v", "node-1", msg.Host)
+	}
+	if msg.Level != 5 {
+		t.Errorf("Level: expected 5, got %d", msg.Level)
+	}
+}
+
+func TestNewGraylogHookWithOptionsDefaults(t *testing.T) {
+	hook, err := NewGraylogHookWithOptions("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	if !hook.Blocking {
+		t.Error("Blocking: expected true by default")
+	}
+	if msg := hook.EntryToMessage(logrus.WithField("foo", "bar"), Caller{}); msg.Facility != LastResortFacility {
+		t.Errorf("Facility: expected %#v, got %#v", LastResortFacility, msg.Facility)
+	}
+}
+
+func TestWithBufSize(t *testing.T) {
+	small, err := NewGraylogHookWithOptions("127.0.0.1:0", WithBufSize(16), WithPrioritizeHighSeverity())
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer small.Close()
+	if cap(small.buf) != 16 || cap(small.highBuf) != 16 {
+		t.Errorf("expected buffers of 16 entries, got %d and %d", cap(small.buf), cap(small.highBuf))
+	}
+
+	hook, err := NewGraylogHookWithOptions("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	if cap(hook.buf) != int(BufSize) {
+		t.Errorf("expected a buffer of BufSize entries by default, got %d", cap(hook.buf))
+	}
+	if hook.highBuf != nil {
+		t.Errorf("expected no high severity buffer by default, got %d entries", cap(hook.highBuf))
+	}
+}
+
+func TestWithCompression(t *testing.T) {
+	r, err := gelf.NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	hook, err := NewGraylogHookWithOptions(r.Addr(), WithCompression(gelf.CompressNone, flate.NoCompression))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	if w := hook.gelfLogger.(*gelf.Writer); w.CompressionType != gelf.CompressNone || w.CompressionLevel != flate.NoCompression {
+		t.Errorf("expected no compression, got type %d and level %d", w.CompressionType, w.CompressionLevel)
+	}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "test message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "test message", msg.Short)
+	}
+}
+
+func TestWithLevels(t *testing.T) {
+	r, err := gelf.NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	hook, err := NewGraylogHookWithOptions(r.Addr(), WithLevels(logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("info message")
+	log.Warn("warning message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "warning message" {
+		t.Errorf("msg.Short: expected only the warning to be sent, got %#v", msg.Short)
+	}
+	if n := len((&Hook{}).Levels()); n != 7 {
+		t.Errorf("expected all the 7 levels by default, got %d", n)
+	}
+}
+
+func TestNewGraylogHookFromWriter(t *testing.T) {
+	r, err := gelf.NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	w, err := gelf.NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w.CompressionType = gelf.CompressNone
+	hook := NewGraylogHookFromWriter(w, "writer_facility", map[string]interface{}{"foo": "bar"}, WithHost("node-1"))
+	if hook.gelfLogger != w {
+		t.Error("expected the hook to send with the writer")
+	}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Info("test message")
+	if err := hook.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Facility != "writer_facility" || msg.Host != "node-1" || msg.Extra["_foo"] != "bar" {
+		t.Errorf("expected the settings of the hook, got %#v", msg)
+	}
+}
+
+// recordingWriter records the messages written, or fails once broken
+type recordingWriter struct {
+	messages []*gelf.Message
+	broken   bool
+}
+
+func (w *recordingWriter) WriteMessage(m *gelf.Message) error {
+	if w.broken {
+		return errors.New("broken")
+	}
+	w.messages = append(w.messages, m)
+	return nil
+}
+
+func (w *recordingWriter) Close() error {
+	return nil
+}
+
+func TestWithDialer(t *testing.T) {
+	var writers []*recordingWriter
+	dial := func(addr string) (MessageWriter, error) {
+		if addr != "quic.example:12201" {
+			t.Errorf("addr: expected %#v, got %#v", "quic.example:12201", addr)
+		}
+		w := &recordingWriter{}
+		writers = append(writers, w)
+		return w, nil
+	}
+	hook, err := NewGraylogHookWithOptions("quic.example:12201", WithDialer(dial), WithSynchronous(1))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	log.Info("first message")
+	// The broken writer is dialed again
+	writers[0].broken = true
+	log.Info("next message")
+
+	if len(writers) != 2 {
+		t.Fatalf("expected 2 writers dialed, got %d", len(writers))
+	}
+	for i, expected := range []string{"first message", "next message"} {
+		if w := writers[i]; len(w.messages) != 1 || w.messages[0].Short != expected {
+			t.Errorf("writer %d: expected %#v, got %v", i, expected, w.messages)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Package otelgraylog adds the OpenTelemetry trace and span IDs of the
+// entries to their Graylog messages, to correlate the logs with the traces.
+// It is a separate package so that the graylog package doesn't depend on
+// OpenTelemetry:
+//
+//	hook.RegisterContextExtractor(otelgraylog.TraceContext)
+//
+// The entries must carry the context of the span, see logrus.WithContext.
+package otelgraylog
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceContext is a graylog.ContextExtractor returning the trace_id and
+// span_id fields of the span context of ctx, sent as _trace_id and _span_id.
+// It returns no fields without a valid span context.
+func TraceContext(ctx context.Context) map[string]interface{} {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return map[string]interface{}{
+		"trace_id": sc.TraceID().String(),
+		"span_id":  sc.SpanID().String(),
+	}
+}
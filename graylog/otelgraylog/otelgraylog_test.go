@@ -0,0 +1,44 @@
+package otelgraylog
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alfatraining/logrus-hooks/graylog"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceContext(t *testing.T) {
+	hook, err := graylog.NewGraylogHook("127.0.0.1:0", "test_facility", nil)
+	if err != nil {
+		t.Fatalf("NewGraylogHook: %s", err)
+	}
+	hook.RegisterContextExtractor(TraceContext)
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	msg := hook.EntryToMessage(logrus.WithContext(ctx), graylog.Caller{})
+
+	expected := map[string]interface{}{
+		"_trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"_span_id":  "00f067aa0ba902b7",
+	}
+	for k, v := range expected {
+		if msg.Extra[k] != v {
+			t.Errorf("%s: expected %#v, got %#v", k, v, msg.Extra[k])
+		}
+	}
+
+	// Without a span context, no fields
+	msg = hook.EntryToMessage(logrus.WithContext(context.Background()), graylog.Caller{})
+	for k := range expected {
+		if v, ok := msg.Extra[k]; ok {
+			t.Errorf("%s: expected none, got %#v", k, v)
+		}
+	}
+}
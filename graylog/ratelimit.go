@@ -0,0 +1,62 @@
+package graylog
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// allow tells whether the rate limit lets an entry through, taking a token
+// from the bucket refilled at RateLimit tokens per second, see
+// Hook.RateLimit. The entries of the AlwaysDeliverLevels are let through
+// without a token. It counts the entries it doesn't let through. It must only
+// be called with sendMu held.
+func (hook *Hook) allow(level logrus.Level, now time.Time) bool {
+	hook.mu.RLock()
+	limit, burst := hook.RateLimit, float64(hook.Burst)
+	hook.mu.RUnlock()
+	if limit <= 0 || hook.alwaysDelivered(level) {
+		return true
+	}
+	if burst <= 0 {
+		burst = limit
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if hook.tokensRefilled.IsZero() {
+		hook.tokens = burst
+	} else {
+		hook.tokens += now.Sub(hook.tokensRefilled).Seconds() * limit
+		if hook.tokens > burst {
+			hook.tokens = burst
+		}
+	}
+	hook.tokensRefilled = now
+	if hook.tokens < 1 {
+		hook.suppressed++
+		hook.statsMu.Lock()
+		hook.rateLimited++
+		hook.statsMu.Unlock()
+		return false
+	}
+	hook.tokens--
+	return true
+}
+
+// takeSuppressed returns the number of entries dropped by the rate limit
+// since the previous call, for the RateLimitedField of the next message. It
+// must only be called with sendMu held.
+func (hook *Hook) takeSuppressed() uint64 {
+	n := hook.suppressed
+	hook.suppressed = 0
+	return n
+}
+
+// RateLimited returns the number of entries dropped because of the rate
+// limit, see Hook.RateLimit.
+func (hook *Hook) RateLimited() uint64 {
+	hook.statsMu.Lock()
+	defer hook.statsMu.Unlock()
+	return hook.rateLimited
+}
@@ -0,0 +1,123 @@
+package graylog
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRateLimit(t *testing.T) {
+	hook, err := NewGraylogHookWithOptions("127.0.0.1:0", WithRateLimit(10, 5))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	const flood = 100
+	start := time.Now()
+	for i := 0; i < flood; i++ {
+		log.Error("storm")
+	}
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	// The burst, plus the tokens refilled during the flood
+	max := 5 + int(time.Since(start).Seconds()*10)
+	if sent := flood - int(hook.RateLimited()); sent < 5 || sent > max {
+		t.Errorf("expected between 5 and %d entries sent, got %d", max, sent)
+	}
+}
+
+func TestSuppressedCount(t *testing.T) {
+	hook, r := newTestHook(t, WithRateLimit(20, 1))
+	hook.RateLimitedField = "limited"
+	hook.SuppressedCountField = "dropped"
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	for i := 0; i < 4; i++ {
+		log.Error("storm")
+	}
+	if err := hook.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond) // a token is refilled
+	log.Error("after the storm")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	for _, field := range []string{"_limited", "_dropped", "_rate_limited", "_suppressed_count"} {
+		if _, ok := msg.Extra[field]; ok {
+			t.Errorf("%s: expected none before the storm, got %v", field, msg.Extra)
+		}
+	}
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "after the storm" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "after the storm", msg.Short)
+	}
+	if msg.Extra["_limited"] != true || msg.Extra["_dropped"] != float64(3) {
+		t.Errorf("expected _limited and a _dropped count of 3, got %v", msg.Extra)
+	}
+	for _, field := range []string{"_rate_limited", "_suppressed_count"} {
+		if _, ok := msg.Extra[field]; ok {
+			t.Errorf("%s: expected the custom names only, got %v", field, msg.Extra)
+		}
+	}
+}
+
+func TestRateLimitAlwaysDeliverLevels(t *testing.T) {
+	hook, r := newTestHook(t, WithRateLimit(1, 1))
+	hook.AlwaysDeliverLevels = []logrus.Level{logrus.ErrorLevel}
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	const flood = 20
+	for i := 0; i < flood; i++ {
+		log.Error("storm")
+	}
+	for i := 0; i < flood; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage %d: %s", i, err)
+		}
+		if msg.Short != "storm" {
+			t.Errorf("msg.Short: expected %#v, got %#v", "storm", msg.Short)
+		}
+	}
+	if n := hook.RateLimited(); n != 0 {
+		t.Errorf("RateLimited: expected 0, got %d", n)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	hook := &Hook{RateLimit: 2, Burst: 1}
+	now := time.Now()
+	if !hook.allow(logrus.ErrorLevel, now) {
+		t.Error("expected the first entry to be allowed")
+	}
+	if hook.allow(logrus.ErrorLevel, now) {
+		t.Error("expected the second entry to be limited")
+	}
+	if !hook.allow(logrus.ErrorLevel, now.Add(500*time.Millisecond)) {
+		t.Error("expected an entry to be allowed once a token was refilled")
+	}
+	if n := hook.RateLimited(); n != 1 {
+		t.Errorf("RateLimited: expected 1, got %d", n)
+	}
+
+	if unlimited := (&Hook{}); !unlimited.allow(logrus.ErrorLevel, now) || !unlimited.allow(logrus.ErrorLevel, now) {
+		t.Error("expected no limit when RateLimit is 0")
+	}
+}
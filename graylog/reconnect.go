@@ -0,0 +1,42 @@
+package graylog
+
+import (
+	"errors"
+	"time"
+)
+
+// errTooManyReconnects is returned by reconnect beyond the
+// MaxReconnectsPerMinute
+var errTooManyReconnects = errors.New("graylog: too many reconnection attempts")
+
+// reconnect dials addr again, unless MaxReconnectsPerMinute attempts were
+// made in the last minute, see Hook.MaxReconnectsPerMinute. It counts the
+// attempts. It must only be called with sendMu held.
+func (hook *Hook) reconnect(addr string) (MessageWriter, error) {
+	if max := hook.MaxReconnectsPerMinute; max > 0 {
+		now := time.Now()
+		recent := hook.reconnects[:0]
+		for _, t := range hook.reconnects {
+			if now.Sub(t) < time.Minute {
+				recent = append(recent, t)
+			}
+		}
+		hook.reconnects = recent
+		if len(recent) >= max {
+			return nil, errTooManyReconnects
+		}
+		hook.reconnects = append(hook.reconnects, now)
+	}
+	hook.statsMu.Lock()
+	hook.reconnectCount++
+	hook.statsMu.Unlock()
+	return hook.dial(addr)
+}
+
+// Reconnects returns the number of times the connection was dialed again,
+// successfully or not, see Hook.MaxReconnectsPerMinute.
+func (hook *Hook) Reconnects() uint64 {
+	hook.statsMu.Lock()
+	defer hook.statsMu.Unlock()
+	return hook.reconnectCount
+}
@@ -0,0 +1,37 @@
+package graylog
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMaxReconnectsPerMinute(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	r := newTCPReader(t, l)
+	defer r.Close()
+
+	hook, err := NewGraylogHookWithOptions(l.Addr().String(), WithTCP())
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	hook.MaxReconnectsPerMinute = 2
+
+	hook.sendMu.Lock()
+	var redialed int
+	for i := 0; i < 5; i++ {
+		if hook.redial() {
+			redialed++
+		}
+	}
+	hook.sendMu.Unlock()
+	if redialed != 2 {
+		t.Errorf("expected 2 redials, got %d", redialed)
+	}
+	if n := hook.Reconnects(); n != 2 {
+		t.Errorf("Reconnects: expected 2, got %d", n)
+	}
+}
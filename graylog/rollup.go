@@ -0,0 +1,220 @@
+package graylog
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRollupInterval is the interval of the rollup rules without one
+const DefaultRollupInterval = time.Minute
+
+// DefaultMaxDedupKeys is the number of rollups counted at once when
+// Hook.MaxDedupKeys is 0
+const DefaultMaxDedupKeys = 10000
+
+// RollupRule matches the entries to aggregate in rollup messages, see
+// Hook.RollupRules.
+//
+// The entries matched by a rule are not sent. Instead, once the interval
+// started by the first of them is over, a single message is sent, like "cache
+// miss occurred 4213 times in the last 1m0s". It has the level, the caller and
+// the fields of the first entry, along with the rollup_count, rollup_first and
+// rollup_last fields: the number of entries and the time of the first and the
+// last of them.
+//
+// An entry more severe than the first one, like an error after warnings, is
+// not hidden in the rollup: the rollup message is sent right away, followed
+// by the entry, and the next entries start a new rollup.
+type RollupRule struct {
+	// MessagePrefix matches the entries whose message starts with it
+	MessagePrefix string
+	// Field matches the entries having this field. The entries are counted
+	// separately for each value of the field.
+	Field string
+	// Interval is the period covered by a rollup message
+	// (DefaultRollupInterval when 0).
+	Interval time.Duration
+}
+
+// rollup counts the entries matched by a rule, for a field value
+type rollup struct {
+	first     graylogEntry
+	interval  time.Duration
+	count     int
+	firstTime time.Time
+	lastTime  time.Time
+	due       time.Time
+	elem      *list.Element // in Hook.rollupOrder
+}
+
+// interval returns the interval of the rule
+func (rule RollupRule) interval() time.Duration {
+	if rule.Interval <= 0 {
+		return DefaultRollupInterval
+	}
+	return rule.Interval
+}
+
+// match returns true when the rule applies to the entry
+func (rule RollupRule) match(entry *logrus.Entry) bool {
+	if rule.MessagePrefix == "" && rule.Field == "" {
+		return false
+	}
+	if rule.MessagePrefix != "" && !strings.HasPrefix(entry.Message, rule.MessagePrefix) {
+		return false
+	}
+	if rule.Field != "" {
+		if _, ok := entry.Data[rule.Field]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// rollup counts the entry if it is matched by a rollup rule, and returns
+// true in that case: the entry must not be sent. It must only be called by
+// fire().
+func (hook *Hook) rollup(entry graylogEntry) bool {
+	if len(hook.RollupRules) == 0 || hook.alwaysDelivered(entry.Level) {
+		return false
+	}
+	for i, rule := range hook.RollupRules {
+		if !rule.match(entry.Entry) {
+			continue
+		}
+
+		key := fmt.Sprint(i)
+		if rule.Field != "" {
+			key += "\x00" + fmt.Sprint(entry.Data[rule.Field])
+		}
+
+		now := time.Now()
+		r, ok := hook.rollups[key]
+		if ok && entry.Level < r.first.Level {
+			// The severity escalated: send the rollup and the entry now,
+			// rather than hiding the entry until the rollup is due
+			hook.sendRollupEarly(key, now)
+			return false
+		}
+		if ok {
+			hook.rollupOrder.MoveToFront(r.elem)
+		} else {
+			if hook.rollups == nil {
+				hook.rollups = map[string]*rollup{}
+				hook.rollupOrder = list.New()
+			}
+			if len(hook.rollups) >= hook.maxDedupKeys() {
+				hook.evictRollup(now)
+			}
+			interval := jitter(rule.interval(), hook.Jitter)
+			r = &rollup{first: entry, interval: interval, firstTime: now, due: now.Add(interval)}
+			r.elem = hook.rollupOrder.PushFront(key)
+			hook.rollups[key] = r
+			hook.startRollupTicker()
+		}
+		r.count++
+		r.lastTime = now
+		return true
+	}
+	return false
+}
+
+// maxDedupKeys returns the number of rollups counted at once
+func (hook *Hook) maxDedupKeys() int {
+	if hook.MaxDedupKeys <= 0 {
+		return DefaultMaxDedupKeys
+	}
+	return hook.MaxDedupKeys
+}
+
+// evictRollup sends the least recently matched rollup before it is due. It
+// must only be called with sendMu held.
+func (hook *Hook) evictRollup(now time.Time) {
+	if elem := hook.rollupOrder.Back(); elem != nil {
+		hook.sendRollupEarly(elem.Value.(string), now)
+	}
+}
+
+// flushRollups sends all the rollups before they are due. It must only be
+// called with sendMu held.
+func (hook *Hook) flushRollups(now time.Time) {
+	for key := range hook.rollups {
+		hook.sendRollupEarly(key, now)
+	}
+}
+
+// sendRollupEarly sends the rollup of key before it is due, with the interval
+// elapsed so far. It must only be called with sendMu held.
+func (hook *Hook) sendRollupEarly(key string, now time.Time) {
+	r := hook.rollups[key]
+	hook.removeRollup(key)
+	r.interval = now.Sub(r.firstTime)
+	hook.send(r.entry())
+}
+
+// removeRollup forgets the rollup of key. It must only be called with sendMu
+// held.
+func (hook *Hook) removeRollup(key string) {
+	hook.rollupOrder.Remove(hook.rollups[key].elem)
+	delete(hook.rollups, key)
+}
+
+// startRollupTicker makes fire() check regularly for due rollups, every
+// second or more often for the rules with a shorter interval.
+func (hook *Hook) startRollupTicker() {
+	if hook.rollupTicker != nil {
+		return
+	}
+	period := time.Second
+	for _, rule := range hook.RollupRules {
+		if rule.interval() < period {
+			period = rule.interval()
+		}
+	}
+	hook.rollupTicker = time.NewTicker(period)
+}
+
+// rollupTick returns the channel of the rollup ticker, nil when not started
+func (hook *Hook) rollupTick() <-chan time.Time {
+	if hook.rollupTicker == nil {
+		return nil
+	}
+	return hook.rollupTicker.C
+}
+
+// emitRollups sends the rollup messages which are due at now. It must only
+// be called with sendMu held.
+func (hook *Hook) emitRollups(now time.Time) {
+	for key, r := range hook.rollups {
+		if now.Before(r.due) {
+			continue
+		}
+		hook.removeRollup(key)
+		hook.send(r.entry())
+	}
+}
+
+// entry returns the entry of the rollup message
+func (r *rollup) entry() graylogEntry {
+	data := make(logrus.Fields, len(r.first.Data)+3)
+	for k, v := range r.first.Data {
+		data[k] = v
+	}
+	data["rollup_count"] = r.count
+	data["rollup_first"] = r.firstTime.Format(rfc3339Milli)
+	data["rollup_last"] = r.lastTime.Format(rfc3339Milli)
+
+	entry := r.first
+	entry.Entry = &logrus.Entry{
+		Logger:  r.first.Logger,
+		Data:    data,
+		Time:    r.firstTime,
+		Level:   r.first.Level,
+		Message: fmt.Sprintf("%s occurred %d times in the last %s", r.first.Message, r.count, r.interval),
+	}
+	return entry
+}
@@ -0,0 +1,108 @@
+package graylog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRollupRules(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.RollupRules = []RollupRule{
+		{MessagePrefix: "cache miss", Interval: 50 * time.Millisecond},
+		{Field: "job", Interval: 50 * time.Millisecond},
+	}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	for i := 0; i < 5; i++ {
+		log.Warn("cache miss")
+	}
+	log.WithField("job", "a").Info("job done")
+	log.WithField("job", "b").Info("job done")
+	log.WithField("job", "a").Info("job done")
+	log.Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "test message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "test message", msg.Short)
+	}
+
+	rollups := map[string]float64{}
+	for i := 0; i < 3; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		job, _ := msg.Extra["_job"].(string)
+		count, _ := msg.Extra["_rollup_count"].(float64)
+		rollups[job+":"+msg.Short] = count
+	}
+	expected := map[string]float64{
+		":cache miss occurred 5 times in the last 50ms": 5,
+		"a:job done occurred 2 times in the last 50ms":  2,
+		"b:job done occurred 1 times in the last 50ms":  1,
+	}
+	for k, count := range expected {
+		if rollups[k] != count {
+			t.Errorf("expected a rollup %#v with a count of %v, got %v", k, count, rollups)
+		}
+	}
+}
+
+func TestMaxDedupKeys(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.RollupRules = []RollupRule{{Field: "job", Interval: time.Hour}}
+	hook.MaxDedupKeys = 2
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.WithField("job", "a").Info("job done")
+	log.WithField("job", "b").Info("job done")
+	log.WithField("job", "b").Info("job done")
+	log.WithField("job", "a").Info("job done")
+	// evicts b, the least recently matched
+	log.WithField("job", "c").Info("job done")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_job"] != "b" || msg.Extra["_rollup_count"] != float64(2) {
+		t.Errorf("expected the rollup of b with a count of 2, got %v", msg.Extra)
+	}
+	if !strings.HasPrefix(msg.Short, "job done occurred 2 times in the last ") {
+		t.Errorf("msg.Short: got %#v", msg.Short)
+	}
+}
+
+func TestRollupEscalation(t *testing.T) {
+	hook, r := newTestHook(t, WithExtra(map[string]interface{}{}))
+	hook.RollupRules = []RollupRule{{MessagePrefix: "disk almost full", Interval: time.Hour}}
+
+	log := logrus.New()
+	log.Hooks.Add(hook)
+	log.Warn("disk almost full")
+	log.Warn("disk almost full")
+	log.Error("disk almost full")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Extra["_rollup_count"] != float64(2) || msg.Level != 4 {
+		t.Errorf("expected the rollup of the 2 warnings, got %#v %v", msg.Short, msg.Extra)
+	}
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "disk almost full" || msg.Level != 3 {
+		t.Errorf("expected the escalated error, got %#v at level %d", msg.Short, msg.Level)
+	}
+}
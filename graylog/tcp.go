@@ -0,0 +1,70 @@
+package graylog
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alfatraining/go-gelf/gelf"
+)
+
+// TCPWriteTimeout is the time allowed to write a message over TCP or a Unix
+// socket, so that a stuck server doesn't block the hook forever
+const TCPWriteTimeout = 10 * time.Second
+
+// MessageWriter writes GELF messages to Graylog, like gelf.Writer. It
+// allows to send over other transports, see WithDialer.
+type MessageWriter interface {
+	WriteMessage(m *gelf.Message) error
+	Close() error
+}
+
+// streamWriter writes GELF messages over TCP or a Unix socket, see WithTCP,
+// WithTLS and WithUnix. By default, the messages are JSON documents
+// terminated by a null byte: GELF over TCP supports neither compression nor
+// chunking.
+type streamWriter struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	encode Encoder
+}
+
+// dialStream connects to addr on network, "tcp" or "unix", with TLS when
+// config isn't nil. The messages are encoded with encode, EncodeJSON when
+// nil.
+func dialStream(network, addr string, config *tls.Config, encode Encoder) (*streamWriter, error) {
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.Dial(network, addr, config)
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if encode == nil {
+		encode = EncodeJSON
+	}
+	return &streamWriter{conn: conn, encode: encode}, nil
+}
+
+// WriteMessage sends a message
+func (w *streamWriter) WriteMessage(m *gelf.Message) error {
+	b, err := w.encode(m)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(TCPWriteTimeout))
+	_, err = w.conn.Write(b)
+	return err
+}
+
+// Close closes the connection
+func (w *streamWriter) Close() error {
+	return w.conn.Close()
+}
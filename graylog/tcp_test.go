@@ -0,0 +1,362 @@
+package graylog
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alfatraining/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
+)
+
+// tcpReader reads the messages sent to a TCP or Unix listener by its
+// clients
+type tcpReader struct {
+	l        net.Listener
+	messages chan *gelf.Message
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func newTCPReader(t *testing.T, l net.Listener) *tcpReader {
+	r := &tcpReader{l: l, messages: make(chan *gelf.Message, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns = append(r.conns, conn)
+			r.mu.Unlock()
+			go r.read(t, conn)
+		}
+	}()
+	return r
+}
+
+func (r *tcpReader) read(t *testing.T, conn net.Conn) {
+	br := bufio.NewReader(conn)
+	for {
+		b, err := br.ReadBytes(0)
+		if err != nil {
+			return
+		}
+		msg := new(gelf.Message)
+		if err := json.Unmarshal(b[:len(b)-1], msg); err != nil {
+			t.Errorf("json.Unmarshal: %s", err)
+		}
+		r.messages <- msg
+	}
+}
+
+// CloseConns closes the connections of the clients, the listener still
+// accepting new ones
+func (r *tcpReader) CloseConns() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.conns = nil
+}
+
+// Close closes the listener and the connections of the clients
+func (r *tcpReader) Close() {
+	r.l.Close()
+	r.CloseConns()
+}
+
+func (r *tcpReader) ReadMessage(t *testing.T) *gelf.Message {
+	select {
+	case msg := <-r.messages:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+// selfSignedCertificate returns a certificate for 127.0.0.1, and the pool of
+// the clients trusting it
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "graylog"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	r := newTCPReader(t, l)
+	defer r.Close()
+
+	hook, err := NewGraylogHookWithOptions(l.Addr().String(), WithTCP(), WithFacility("test_facility"))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	hook.Fire(logrus.WithField("foo", "bar"))
+
+	msg := r.ReadMessage(t)
+	if msg.Facility != "test_facility" {
+		t.Errorf("msg.Facility: expected %#v, got %#v", "test_facility", msg.Facility)
+	}
+	if msg.Extra["_foo"] != "bar" {
+		t.Errorf("_foo: expected %#v, got %#v", "bar", msg.Extra["_foo"])
+	}
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := selfSignedCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	r := newTCPReader(t, l)
+	defer r.Close()
+
+	hook, err := NewGraylogHookWithOptions(l.Addr().String(), WithTLS(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	hook.Fire(logrus.WithField("foo", "bar"))
+
+	msg := r.ReadMessage(t)
+	if msg.Extra["_foo"] != "bar" {
+		t.Errorf("_foo: expected %#v, got %#v", "bar", msg.Extra["_foo"])
+	}
+}
+
+func TestTLSUnknownAuthority(t *testing.T) {
+	cert, _ := selfSignedCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	_, err = NewGraylogHookWithOptions(l.Addr().String(), WithTLS(&tls.Config{}))
+	if err == nil {
+		t.Fatal("expected an error for a server certificate signed by an unknown authority")
+	}
+}
+
+func TestUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	if _, err := NewGraylogHookUnix(path, "test_facility", nil); err == nil {
+		t.Error("expected an error for a missing socket")
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	r := newTCPReader(t, l)
+	defer r.Close()
+
+	hook, err := NewGraylogHookUnix(path, "test_facility", map[string]interface{}{"foo": "bar"})
+	if err != nil {
+		t.Fatalf("NewGraylogHookUnix: %s", err)
+	}
+	defer hook.Close()
+	hook.Fire(logrus.WithField("baz", "qux"))
+
+	msg := r.ReadMessage(t)
+	if msg.Facility != "test_facility" {
+		t.Errorf("msg.Facility: expected %#v, got %#v", "test_facility", msg.Facility)
+	}
+	if msg.Extra["_foo"] != "bar" || msg.Extra["_baz"] != "qux" {
+		t.Errorf("expected the _foo and _baz fields, got %v", msg.Extra)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	var readers []*tcpReader
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %s", err)
+		}
+		r := newTCPReader(t, l)
+		defer r.Close()
+		readers = append(readers, r)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	hook, err := NewGraylogHookWithFailover(addrs, WithTCP())
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithFailover: %s", err)
+	}
+	defer hook.Close()
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	log.Info("first message")
+	if msg := readers[0].ReadMessage(t); msg.Short != "first message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "first message", msg.Short)
+	}
+	if addr := hook.ActiveAddr(); addr != addrs[0] {
+		t.Errorf("ActiveAddr: expected %s, got %s", addrs[0], addr)
+	}
+
+	// The first write after the server went away may still succeed: TCP
+	// only reports the failure on the following ones
+	readers[0].Close()
+	for i := 0; i < 10 && hook.ActiveAddr() == addrs[0]; i++ {
+		log.Info("next message")
+		if err := hook.Flush(context.Background()); err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+	}
+	if addr := hook.ActiveAddr(); addr != addrs[1] {
+		t.Fatalf("ActiveAddr: expected %s, got %s", addrs[1], addr)
+	}
+	if msg := readers[1].ReadMessage(t); msg.Short != "next message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "next message", msg.Short)
+	}
+	if n := hook.WriteErrors(); n != 0 {
+		t.Errorf("WriteErrors: expected 0, got %d", n)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	r := newTCPReader(t, l)
+	defer r.Close()
+
+	hook, err := NewGraylogHookWithOptions(l.Addr().String(), WithTCP())
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithOptions: %s", err)
+	}
+	defer hook.Close()
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	log.Info("first message")
+	if msg := r.ReadMessage(t); msg.Short != "first message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "first message", msg.Short)
+	}
+
+	// The server drops the connection without MaxRetries: the hook dials
+	// again once the writes fail
+	r.CloseConns()
+	for i := 0; i < 10 && len(r.messages) == 0; i++ {
+		log.Info("next message")
+		if err := hook.Flush(context.Background()); err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if msg := r.ReadMessage(t); msg.Short != "next message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "next message", msg.Short)
+	}
+	if n := hook.WriteErrors(); n != 0 {
+		t.Errorf("WriteErrors: expected 0, got %d", n)
+	}
+}
+
+func TestTransportChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	tcp := newTCPReader(t, l)
+	defer tcp.Close()
+
+	// The preferred Unix socket isn't there yet
+	addrs := []string{"unix://" + path, "tcp://" + l.Addr().String()}
+	hook, err := NewGraylogHookWithFailover(addrs)
+	if err != nil {
+		t.Fatalf("NewGraylogHookWithFailover: %s", err)
+	}
+	defer hook.Close()
+	hook.FailbackInterval = 10 * time.Millisecond
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	log.Info("first message")
+	if msg := tcp.ReadMessage(t); msg.Short != "first message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "first message", msg.Short)
+	}
+	if addr := hook.ActiveAddr(); addr != addrs[1] {
+		t.Errorf("ActiveAddr: expected %s, got %s", addrs[1], addr)
+	}
+
+	ul, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	unix := newTCPReader(t, ul)
+	defer unix.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	log.Info("next message")
+	if msg := unix.ReadMessage(t); msg.Short != "next message" {
+		t.Errorf("msg.Short: expected %#v, got %#v", "next message", msg.Short)
+	}
+	if addr := hook.ActiveAddr(); addr != addrs[0] {
+		t.Errorf("ActiveAddr: expected %s, got %s", addrs[0], addr)
+	}
+}
+
+func TestFailoverNoAddress(t *testing.T) {
+	if _, err := NewGraylogHookWithFailover(nil); err != ErrNoAddress {
+		t.Errorf("expected ErrNoAddress, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package graylog
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// ulidEncoding is the Crockford's base32 alphabet used to encode ULIDs
+const ulidEncoding = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator generates ULIDs (https://github.com/ulid/spec): 26 characters
+// identifiers made of a millisecond timestamp and random bits, which sort
+// lexicographically by time. Within the same millisecond the random part is
+// incremented, so that the identifiers of a generator are strictly increasing.
+type ulidGenerator struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+// New returns a new ULID for t, or for the time of the last ULID if t is
+// earlier.
+func (g *ulidGenerator) New(t time.Time) string {
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		for i := len(g.entropy) - 1; i >= 0; i-- {
+			g.entropy[i]++
+			if g.entropy[i] != 0 {
+				break
+			}
+		}
+	} else {
+		g.lastMs = ms
+		rand.Read(g.entropy[:])
+	}
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> uint(40-8*i))
+	}
+	copy(id[6:], g.entropy[:])
+	return encodeULID(id)
+}
+
+// encodeULID encodes the 128 bits of a ULID in 26 base32 characters, the
+// first one only holding 3 bits.
+func encodeULID(id [16]byte) string {
+	var out [26]byte
+	for i := range out {
+		var v byte
+		for b := 0; b < 5; b++ {
+			bit := i*5 + b - 2 // 130 encoded bits for 128
+			v <<= 1
+			if bit >= 0 && id[bit/8]&(0x80>>uint(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = ulidEncoding[v]
+	}
+	return string(out[:])
+}
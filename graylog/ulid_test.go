@@ -0,0 +1,39 @@
+package graylog
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeULID(t *testing.T) {
+	var id [16]byte
+	if s := encodeULID(id); s != strings.Repeat("0", 26) {
+		t.Errorf("expected only zeros, got %s", s)
+	}
+	for i := range id {
+		id[i] = 0xff
+	}
+	if s := encodeULID(id); s != "7"+strings.Repeat("Z", 25) {
+		t.Errorf("expected the maximum ULID, got %s", s)
+	}
+}
+
+func TestULIDGenerator(t *testing.T) {
+	var g ulidGenerator
+	// example of the specification
+	now := time.Unix(0, 1469918176385*int64(time.Millisecond))
+
+	first := g.New(now)
+	if !strings.HasPrefix(first, "01ARYZ6S41") {
+		t.Errorf("expected the timestamp to be encoded as 01ARYZ6S41, got %s", first)
+	}
+	second := g.New(now)
+	if second <= first {
+		t.Errorf("expected %s to sort after %s", second, first)
+	}
+	third := g.New(now.Add(-time.Second))
+	if third <= second {
+		t.Errorf("expected %s to sort after %s", third, second)
+	}
+}
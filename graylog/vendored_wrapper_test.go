@@ -0,0 +1,9 @@
+package graylog
+
+import "github.com/sirupsen/logrus"
+
+// logThroughWrapper stands for a logging wrapper living in a vendored
+// package, see TestIgnoreCallerPaths.
+func logThroughWrapper(log *logrus.Logger, msg string) {
+	log.Info(msg)
+}